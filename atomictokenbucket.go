@@ -0,0 +1,250 @@
+package krakendrate
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewAtomicTokenBucket returns a lock-free token bucket with the given rate and capacity, using the
+// default clock and an initial stock of capacity
+func NewAtomicTokenBucket(rate float64, capacity uint64) *AtomicTokenBucket {
+	return NewAtomicTokenBucketWithClock(rate, capacity, nil)
+}
+
+// NewAtomicTokenBucketWithClock returns a lock-free token bucket with the given rate, capacity and
+// clock and an initial stock of capacity
+func NewAtomicTokenBucketWithClock(rate float64, capacity uint64, c Clock) *AtomicTokenBucket {
+	t := new(AtomicTokenBucket)
+	t.init(rate, capacity, c)
+	return t
+}
+
+func (t *AtomicTokenBucket) init(rate float64, capacity uint64, c Clock) {
+	if c == nil {
+		c = defaultClock{}
+	}
+	t.clock = c
+	t.mu = new(sync.Mutex)
+	st := newAtomicBucketState(rate, capacity)
+	st.empty.Store(c.Now().UnixNano() - st.burst)
+	t.state.Store(st)
+}
+
+// AtomicTokenBucket is a lock-free implementation of the token bucket pattern, suitable for limiters
+// shared by all the requests of an endpoint.
+//
+// Instead of storing the amount of tokens and the time of the last refill, its whole state is a
+// single word with the instant (in nanoseconds) when the bucket was empty: the tokens available at
+// any instant are the ones generated since then, up to the capacity. Consuming tokens moves that
+// instant forward with a CAS operation, and moving it beyond the present puts the bucket in debt.
+//
+// The time between two tokens is rounded to the nearest nanosecond, so the effective rate deviates
+// from the configured one less than half a nanosecond per token. Changing the rate or the capacity
+// seals the current state and replaces it with a rescaled one, so the concurrent operations retry
+// against the new state instead of getting lost.
+type AtomicTokenBucket struct {
+	state atomic.Pointer[atomicBucketState]
+	clock Clock
+	// mu serialises the changes of rate and capacity
+	mu *sync.Mutex
+}
+
+// atomicBucketState is the state of an AtomicTokenBucket with a given rate and capacity. Only its
+// empty instant changes, until it is sealed by a change of the rate or the capacity
+type atomicBucketState struct {
+	empty    atomic.Int64
+	interval int64
+	capacity uint64
+	burst    int64
+}
+
+// sealedBucket is the empty instant of the replaced states
+const sealedBucket = math.MinInt64
+
+func newAtomicBucketState(rate float64, capacity uint64) *atomicBucketState {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if rate < 1e-9 {
+		rate = 1e-9
+	}
+	interval := int64(math.Round(1e9 / rate))
+	if interval < 1 {
+		interval = 1
+	}
+	// keep the time required to fill the bucket far from the int64 limits
+	if maxCapacity := uint64(math.MaxInt64 / 4 / interval); capacity > maxCapacity {
+		capacity = maxCapacity
+	}
+	return &atomicBucketState{
+		interval: interval,
+		capacity: capacity,
+		burst:    int64(capacity) * interval,
+	}
+}
+
+// load returns the current state of the bucket and its empty instant, waiting for the
+// replacement of a sealed state if required
+func (t *AtomicTokenBucket) load() (*atomicBucketState, int64) {
+	for {
+		st := t.state.Load()
+		if empty := st.empty.Load(); empty != sealedBucket {
+			return st, empty
+		}
+		runtime.Gosched()
+	}
+}
+
+// SetRate changes the refill rate of the bucket. The tokens available, or owed, are kept.
+func (t *AtomicTokenBucket) SetRate(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.state.Load()
+	t.replace(st, newAtomicBucketState(rate, st.capacity), 1)
+}
+
+// SetCapacity changes the capacity of the bucket, rescaling the current amount of tokens
+// proportionally, so a half-full bucket is still half-full after the change.
+func (t *AtomicTokenBucket) SetCapacity(capacity uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.state.Load()
+	next := newAtomicBucketState(1e9/float64(st.interval), capacity)
+	t.replace(st, next, float64(next.capacity)/float64(st.capacity))
+}
+
+// replace seals the current state and stores the next one, with the tokens available in the
+// current one multiplied by the scale. Debts are not scaled
+func (t *AtomicTokenBucket) replace(current, next *atomicBucketState, scale float64) {
+	now := t.clock.Now().UnixNano()
+	empty := current.empty.Swap(sealedBucket)
+	tokens := float64(now-current.base(empty, now)) / float64(current.interval)
+	if tokens > 0 {
+		tokens *= scale
+	}
+	next.empty.Store(now - int64(math.Round(tokens*float64(next.interval))))
+	t.state.Store(next)
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (t *AtomicTokenBucket) Allow() bool {
+	return t.AllowN(1)
+}
+
+// AllowN flags if n tokens can be consumed from the bucket or not. It updates the internal state if
+// the tokens can be consumed
+func (t *AtomicTokenBucket) AllowN(n uint64) bool {
+	return t.allowAt(n, t.clock.Now().UnixNano())
+}
+
+func (t *AtomicTokenBucket) allowAt(n uint64, now int64) bool {
+	for {
+		st, empty := t.load()
+		if n > st.capacity {
+			return false
+		}
+		next := st.base(empty, now) + int64(n)*st.interval
+		if next > now {
+			return false
+		}
+		if st.empty.CompareAndSwap(empty, next) {
+			return true
+		}
+	}
+}
+
+// Reserve takes n tokens from the bucket, even if they are not available yet, and returns a
+// Reservation reporting when they can be used. The reservation is not OK if n exceeds the
+// capacity of the bucket.
+func (t *AtomicTokenBucket) Reserve(n uint64) *Reservation {
+	now := t.clock.Now()
+	nowNano := now.UnixNano()
+	for {
+		st, empty := t.load()
+		if n > st.capacity {
+			return &Reservation{}
+		}
+		next := st.base(empty, nowNano) + int64(n)*st.interval
+		if !st.empty.CompareAndSwap(empty, next) {
+			continue
+		}
+		r := &Reservation{
+			ok:        true,
+			tokens:    n,
+			timeToAct: now,
+			clock:     t.clock,
+			refund:    t.Refund,
+		}
+		if next > nowNano {
+			r.timeToAct = now.Add(time.Duration(next - nowNano))
+		}
+		return r
+	}
+}
+
+// Charge takes n tokens from the bucket after the fact, even if they are not available. When the
+// bucket does not have enough tokens, it goes into debt and rejects the requests until the refills
+// repay it.
+func (t *AtomicTokenBucket) Charge(n uint64) {
+	now := t.clock.Now().UnixNano()
+	// keep the debt far from the int64 limits
+	maxEmpty := now + math.MaxInt64/4
+	for {
+		st, empty := t.load()
+		next := st.base(empty, now)
+		if d := maxEmpty - next; d <= 0 || n > uint64(d/st.interval) {
+			next = maxEmpty
+		} else {
+			next += int64(n) * st.interval
+		}
+		if st.empty.CompareAndSwap(empty, next) {
+			return
+		}
+	}
+}
+
+// Refund gives n tokens back to the bucket. They repay its debt, if any, before being added
+func (t *AtomicTokenBucket) Refund(n uint64) {
+	for {
+		st, empty := t.load()
+		if st.empty.CompareAndSwap(empty, empty-int64(n)*st.interval) {
+			return
+		}
+	}
+}
+
+// State returns the current state of the bucket
+func (t *AtomicTokenBucket) State() LimiterState {
+	return t.stateAt(t.clock.Now().UnixNano())
+}
+
+func (t *AtomicTokenBucket) stateAt(now int64) LimiterState {
+	s, empty := t.load()
+	base := s.base(empty, now)
+
+	st := LimiterState{Limit: s.capacity}
+	if elapsed := now - base; elapsed >= s.interval {
+		st.Remaining = uint64(elapsed / s.interval)
+	} else {
+		st.RetryAfter = time.Duration(base + s.interval - now)
+	}
+	if reset := base + s.burst - now; reset > 0 && st.Remaining < s.capacity {
+		st.Reset = time.Duration(reset)
+	}
+	return st
+}
+
+// base returns the instant the bucket was empty, normalized so the bucket never holds more
+// tokens than its capacity at the instant now
+func (s *atomicBucketState) base(empty, now int64) int64 {
+	if full := now - s.burst; empty < full {
+		return full
+	}
+	return empty
+}
@@ -0,0 +1,42 @@
+package krakendrate
+
+import (
+	"testing"
+)
+
+func BenchmarkAtomicTokenBucket(b *testing.B) {
+	tb := NewAtomicTokenBucket(1000, 100)
+	for i := 0; i < b.N; i++ {
+		tb.Allow()
+	}
+}
+
+// the parallel benchmarks show the contention of a bucket shared by all the requests
+// of an endpoint. Run them with -cpu 1,4,16 in order to compare both implementations.
+
+func BenchmarkTokenBucket_parallel(b *testing.B) {
+	tb := NewTokenBucket(1e6, 1000)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Allow()
+		}
+	})
+}
+
+func BenchmarkAtomicTokenBucket_parallel(b *testing.B) {
+	tb := NewAtomicTokenBucket(1e6, 1000)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Allow()
+		}
+	})
+}
+
+func BenchmarkShardedTokenBucket_parallel(b *testing.B) {
+	tb := NewShardedTokenBucket(1e6, 1000, 0)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Allow()
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package krakendrate
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAtomicTokenBucket(t *testing.T) {
+	clk := newTestClock()
+	tb := NewAtomicTokenBucketWithClock(10, 5, clk)
+
+	if st := tb.State(); st != (LimiterState{Limit: 5, Remaining: 5}) {
+		t.Errorf("unexpected state of a full bucket: %+v", st)
+	}
+	if !tb.AllowN(4) {
+		t.Error("4 tokens should be allowed")
+	}
+	if !tb.Allow() {
+		t.Error("the last token should be allowed")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+
+	clk.Add(50 * time.Millisecond)
+	want := LimiterState{Limit: 5, RetryAfter: 50 * time.Millisecond, Reset: 450 * time.Millisecond}
+	if st := tb.State(); st != want {
+		t.Errorf("unexpected state of an empty bucket: %+v", st)
+	}
+
+	clk.Add(250 * time.Millisecond)
+	if !tb.AllowN(3) {
+		t.Error("3 tokens should be allowed after the refill")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty after consuming the refill")
+	}
+
+	clk.Add(time.Hour)
+	if tb.AllowN(6) {
+		t.Error("the bucket should not allow more tokens than its capacity")
+	}
+	if !tb.AllowN(5) {
+		t.Error("the bucket should be full after a long idle period")
+	}
+}
+
+func TestAtomicTokenBucket_Reserve(t *testing.T) {
+	clk := newTestClock()
+	tb := NewAtomicTokenBucketWithClock(10, 2, clk)
+
+	if r := tb.Reserve(2); !r.OK() || r.Delay() != 0 {
+		t.Error("the tokens should be available right now")
+	}
+	r := tb.Reserve(2)
+	if d := r.Delay(); !r.OK() || d != 200*time.Millisecond {
+		t.Errorf("unexpected delay: %s", d)
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be in debt")
+	}
+	r.Cancel()
+	clk.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the refunded tokens should be available after the refill")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+	if r := tb.Reserve(3); r.OK() {
+		t.Error("reservations exceeding the capacity should not be ok")
+	}
+}
+
+func TestAtomicTokenBucket_concurrency(t *testing.T) {
+	tb := NewAtomicTokenBucket(1e-3, 1000)
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if tb.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1000 {
+		t.Errorf("unexpected number of allowed requests: %d", allowed)
+	}
+}
+
+func TestAtomicTokenBucket_Charge(t *testing.T) {
+	clk := newTestClock()
+	tb := NewAtomicTokenBucketWithClock(10, 10, clk)
+
+	tb.Charge(15)
+	if st := tb.State(); st.Remaining != 0 || st.RetryAfter != 600*time.Millisecond {
+		t.Errorf("unexpected state of a bucket in debt: %+v", st)
+	}
+	clk.Add(500 * time.Millisecond)
+	if tb.Allow() {
+		t.Error("the request should be rejected until the debt is repaid")
+	}
+	clk.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the request should be allowed once the debt is repaid")
+	}
+
+	tb.Charge(math.MaxUint64)
+	if tb.Allow() {
+		t.Error("the bucket should be in debt")
+	}
+}
+
+func TestAtomicTokenBucket_SetRate(t *testing.T) {
+	clk := newTestClock()
+	tb := NewAtomicTokenBucketWithClock(10, 10, clk)
+
+	tb.AllowN(8)
+	clk.Add(50 * time.Millisecond)
+	// half a token was generated with the old rate, so a quarter of a second is
+	// needed to complete it with the new one
+	tb.SetRate(2)
+	if st := tb.State(); st.Remaining != 2 || st.RetryAfter != 0 || st.Reset != 3750*time.Millisecond {
+		t.Errorf("unexpected state after changing the rate: %+v", st)
+	}
+
+	tb.AllowN(2)
+	clk.Add(249 * time.Millisecond)
+	if tb.Allow() {
+		t.Error("the token should not be ready yet")
+	}
+	clk.Add(time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the token should be ready")
+	}
+}
+
+func TestAtomicTokenBucket_SetCapacity(t *testing.T) {
+	clk := newTestClock()
+	tb := NewAtomicTokenBucketWithClock(1, 10, clk)
+
+	tb.AllowN(4)
+	tb.SetCapacity(5)
+	if st := tb.State(); st.Limit != 5 || st.Remaining != 3 {
+		t.Errorf("unexpected state after reducing the capacity: %+v", st)
+	}
+
+	tb.SetCapacity(20)
+	if st := tb.State(); st.Limit != 20 || st.Remaining != 12 {
+		t.Errorf("unexpected state after increasing the capacity: %+v", st)
+	}
+
+	clk.Add(time.Hour)
+	if !tb.AllowN(20) {
+		t.Error("the bucket should be refilled up to the new capacity")
+	}
+}
+
+func TestAtomicTokenBucket_setRateConcurrently(t *testing.T) {
+	tb := NewAtomicTokenBucket(1e-3, 1000)
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if tb.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+				if j%50 == 0 {
+					tb.SetRate(2e-3)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every change of the rate keeps the tokens left, so no token is lost nor created
+	if allowed != 1000 {
+		t.Errorf("unexpected number of allowed requests: %d", allowed)
+	}
+}
+
+func TestAtomicTokenBucket_roundedInterval(t *testing.T) {
+	tb := NewAtomicTokenBucket(1.5, 1)
+	if interval := tb.state.Load().interval; interval != 666666667 {
+		t.Errorf("unexpected interval: %d", interval)
+	}
+}
@@ -0,0 +1,210 @@
+package krakendrate
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CalendarPeriod is the calendar unit used by the CalendarQuota to reset its counter
+type CalendarPeriod int
+
+const (
+	// Daily quotas reset at midnight
+	Daily CalendarPeriod = iota
+	// Weekly quotas reset on Monday at midnight
+	Weekly
+	// Monthly quotas reset on the first day of the month at midnight
+	Monthly
+	// Yearly quotas reset on January 1st at midnight
+	Yearly
+)
+
+// ErrUnknownPeriod is the error returned when parsing an unknown calendar period
+var ErrUnknownPeriod = errors.New("unknown calendar period")
+
+// ParseCalendarPeriod returns the CalendarPeriod matching the received name: day, week, month or year
+func ParseCalendarPeriod(s string) (CalendarPeriod, error) {
+	switch strings.ToLower(s) {
+	case "day", "daily":
+		return Daily, nil
+	case "week", "weekly":
+		return Weekly, nil
+	case "month", "monthly":
+		return Monthly, nil
+	case "year", "yearly":
+		return Yearly, nil
+	default:
+		return Daily, ErrUnknownPeriod
+	}
+}
+
+// MaxDuration returns the longest possible duration of the period, taking into account
+// leap years and DST changes
+func (p CalendarPeriod) MaxDuration() time.Duration {
+	switch p {
+	case Weekly:
+		return 7*24*time.Hour + time.Hour
+	case Monthly:
+		return 31*24*time.Hour + time.Hour
+	case Yearly:
+		return 366*24*time.Hour + time.Hour
+	default:
+		return 25 * time.Hour
+	}
+}
+
+// start returns the beginning of the period containing t in the given location
+func (p CalendarPeriod) start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch p {
+	case Weekly:
+		// time.Weekday starts on Sunday, but the weeks start on Monday
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case Monthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case Yearly:
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+}
+
+// next returns the beginning of the period following the one starting at start
+func (p CalendarPeriod) next(start time.Time) time.Time {
+	switch p {
+	case Weekly:
+		return start.AddDate(0, 0, 7)
+	case Monthly:
+		return start.AddDate(0, 1, 0)
+	case Yearly:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// NewCalendarQuota returns a calendar quota limiter allowing up to limit requests per calendar
+// period in the given location, using the default clock
+func NewCalendarQuota(limit uint64, period CalendarPeriod, loc *time.Location) *CalendarQuota {
+	return NewCalendarQuotaWithClock(limit, period, loc, nil)
+}
+
+// NewCalendarQuotaWithClock returns a calendar quota limiter allowing up to limit requests per
+// calendar period in the given location, using the received clock
+func NewCalendarQuotaWithClock(limit uint64, period CalendarPeriod, loc *time.Location, c Clock) *CalendarQuota {
+	return NewCalendarQuotaBuilder(limit, period, loc, c)().(*CalendarQuota)
+}
+
+// NewCalendarQuotaBuilder returns a LimiterBuilderFn creating calendar quota limiters with the
+// given limit, period, location and clock. A nil location means UTC.
+func NewCalendarQuotaBuilder(limit uint64, period CalendarPeriod, loc *time.Location, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	return func() interface{} {
+		return &CalendarQuota{
+			limit:    limit,
+			period:   period,
+			location: loc,
+			clock:    clk,
+			mu:       new(sync.Mutex),
+		}
+	}
+}
+
+// CalendarQuota is a fixed window limiter whose windows are calendar periods in a given location,
+// so a daily quota for Europe/Madrid resets at midnight in Madrid, whatever the DST offset is.
+type CalendarQuota struct {
+	limit    uint64
+	period   CalendarPeriod
+	location *time.Location
+	clock    Clock
+	end      time.Time
+	count    uint64
+	mu       *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (q *CalendarQuota) Allow() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rotate(q.clock.Now())
+	if q.count >= q.limit {
+		return false
+	}
+	q.count++
+	return true
+}
+
+// NextReset returns the instant when the current period ends and the quota is restored
+func (q *CalendarQuota) NextReset() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rotate(q.clock.Now())
+	return q.end
+}
+
+// Refund gives n requests back to the current period
+func (q *CalendarQuota) Refund(n uint64) {
+	q.mu.Lock()
+	if n > q.count {
+		n = q.count
+	}
+	q.count -= n
+	q.mu.Unlock()
+}
+
+// Charge adds n requests to the current period, even if they exceed the quota
+func (q *CalendarQuota) Charge(n uint64) {
+	q.mu.Lock()
+	q.rotate(q.clock.Now())
+	if n > math.MaxUint64-q.count {
+		q.count = math.MaxUint64
+	} else {
+		q.count += n
+	}
+	q.mu.Unlock()
+}
+
+// State returns the current state of the limiter
+func (q *CalendarQuota) State() LimiterState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.clock.Now()
+	q.rotate(n)
+	st := LimiterState{Limit: q.limit}
+	if q.count < q.limit {
+		st.Remaining = q.limit - q.count
+	}
+	if q.count > 0 {
+		st.Reset = q.end.Sub(n)
+	}
+	if st.Remaining == 0 {
+		st.RetryAfter = st.Reset
+	}
+	return st
+}
+
+// rotate resets the counter if the instant n is out of the current period
+func (q *CalendarQuota) rotate(n time.Time) {
+	if n.Before(q.end) {
+		return
+	}
+	q.end = q.period.next(q.period.start(n, q.location))
+	q.count = 0
+}
@@ -0,0 +1,92 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarQuota_daily(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip(err)
+	}
+	clk := newTestClock()
+	// 22:30 UTC is 23:30 in Madrid during the winter
+	clk.Set(time.Date(2024, 1, 15, 22, 30, 0, 0, time.UTC))
+	q := NewCalendarQuotaWithClock(2, Daily, loc, clk)
+
+	for i := 0; i < 2; i++ {
+		if !q.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if q.Allow() {
+		t.Error("the 3rd request should be rejected")
+	}
+	if reset := q.NextReset(); !reset.Equal(time.Date(2024, 1, 15, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected reset: %s", reset)
+	}
+
+	clk.Add(30 * time.Minute)
+	if !q.Allow() {
+		t.Error("the quota should be restored at midnight in Madrid")
+	}
+}
+
+func TestCalendarQuota_monthly(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip(err)
+	}
+	clk := newTestClock()
+	clk.Set(time.Date(2024, 3, 31, 12, 0, 0, 0, loc))
+	q := NewCalendarQuotaWithClock(1, Monthly, loc, clk)
+
+	if !q.Allow() {
+		t.Error("the first request should be allowed")
+	}
+	if q.Allow() {
+		t.Error("the second request should be rejected")
+	}
+	// Madrid switched to summer time on March 31st, 2024
+	want := LimiterState{Limit: 1, RetryAfter: 12 * time.Hour, Reset: 12 * time.Hour}
+	if st := q.State(); st != want {
+		t.Errorf("unexpected state: %+v", st)
+	}
+
+	clk.Set(time.Date(2024, 4, 1, 0, 0, 0, 0, loc))
+	if !q.Allow() {
+		t.Error("the quota should be restored on the first day of the month")
+	}
+}
+
+func TestCalendarPeriod(t *testing.T) {
+	ref := time.Date(2024, 2, 29, 15, 4, 5, 0, time.UTC) // a Thursday
+	for _, tc := range []struct {
+		name  string
+		start time.Time
+		next  time.Time
+	}{
+		{name: "day", start: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), next: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "week", start: time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), next: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{name: "month", start: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), next: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "year", start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), next: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		p, err := ParseCalendarPeriod(tc.name)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		start := p.start(ref, time.UTC)
+		if !start.Equal(tc.start) {
+			t.Errorf("%s: unexpected start: %s", tc.name, start)
+		}
+		if next := p.next(start); !next.Equal(tc.next) {
+			t.Errorf("%s: unexpected next: %s", tc.name, next)
+		}
+	}
+
+	if _, err := ParseCalendarPeriod("fortnight"); err != ErrUnknownPeriod {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Package cluster adapts the local limiters to the size of the cluster, so every node enforces its
+// share of the limits without a shared datastore: with N live nodes, every one of them accepts
+// max_rate/N requests per second.
+package cluster
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+// Membership is the interface of the sources of the number of live nodes of the cluster
+type Membership interface {
+	// Size returns the number of live nodes, including the local one
+	Size() int
+}
+
+// Static is a Membership with a fixed list of peers, all of them considered alive
+type Static int
+
+// NewStatic returns a Membership of the local node and the received peers
+func NewStatic(peers []string) Static {
+	return Static(len(peers) + 1)
+}
+
+// Size implements the Membership interface
+func (s Static) Size() int {
+	return int(s)
+}
+
+// Scalable is the interface of the limiters whose rate and capacity can be changed after their
+// creation, like the krakendrate.TokenBucket
+type Scalable interface {
+	SetRate(float64)
+	SetCapacity(uint64)
+}
+
+// WarmUpScalable is the interface of the Scalable limiters with a warm-up ramp whose initial rate
+// can also be changed, like the warming krakendrate.TokenBucket
+type WarmUpScalable interface {
+	Scalable
+	SetColdRate(float64)
+}
+
+// Divider rescales the registered limiters, dividing their rate and capacity by the size of the
+// cluster every time it changes
+type Divider struct {
+	membership Membership
+	// size is read without the lock by the builders of the stores, since they can be called while
+	// the backends are locked
+	size    *atomic.Int64
+	targets []func(n int)
+	mu      *sync.Mutex
+}
+
+// NewDivider returns a Divider checking the size of the membership at the given interval until
+// the context is cancelled. An interval of zero means one second
+func NewDivider(ctx context.Context, m Membership, interval time.Duration) *Divider {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	d := &Divider{
+		membership: m,
+		size:       new(atomic.Int64),
+		mu:         new(sync.Mutex),
+	}
+	d.size.Store(int64(clusterSize(m)))
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				d.Refresh()
+			}
+		}
+	}()
+	return d
+}
+
+// Size returns the last known size of the cluster
+func (d *Divider) Size() int {
+	return int(d.size.Load())
+}
+
+// Refresh checks the size of the membership, rescaling all the registered limiters if it changed
+func (d *Divider) Refresh() {
+	n := clusterSize(d.membership)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if int64(n) == d.size.Load() {
+		return
+	}
+	d.size.Store(int64(n))
+	for _, f := range d.targets {
+		f(n)
+	}
+}
+
+// Bucket registers a limiter with the given cluster-wide rate and capacity, rescaling it to the
+// current size of the cluster
+func (d *Divider) Bucket(l Scalable, rate float64, capacity uint64) {
+	f := func(n int) {
+		r, c := divide(rate, capacity, n)
+		l.SetRate(r)
+		l.SetCapacity(c)
+	}
+
+	d.mu.Lock()
+	d.targets = append(d.targets, f)
+	f(d.Size())
+	d.mu.Unlock()
+}
+
+// WarmUpBucket registers a limiter warming up from the given cluster-wide cold rate to the
+// cluster-wide rate, rescaling both rates and the capacity to the current size of the cluster
+func (d *Divider) WarmUpBucket(l WarmUpScalable, rate, coldRate float64, capacity uint64) {
+	f := func(n int) {
+		r, c := divide(rate, capacity, n)
+		cold, _ := divide(coldRate, capacity, n)
+		l.SetRate(r)
+		l.SetColdRate(cold)
+		l.SetCapacity(c)
+	}
+
+	d.mu.Lock()
+	d.targets = append(d.targets, f)
+	f(d.Size())
+	d.mu.Unlock()
+}
+
+// Store returns a LimiterStore whose limiters have the given cluster-wide rate and capacity. The
+// limiters created by the builder are rescaled to the current size of the cluster, and the ones
+// already stored in the backend are rescaled when it changes. The limiters not implementing the
+// Scalable interface are not modified.
+func (d *Divider) Store(backend krakendrate.TypedBackend[krakendrate.Limiter], builder func() krakendrate.Limiter, rate float64, capacity uint64) krakendrate.LimiterStore {
+	cb := krakendrate.NewContextBackend(backend)
+	scale := func(l krakendrate.Limiter, n int) {
+		if s, ok := l.(Scalable); ok {
+			r, c := divide(rate, capacity, n)
+			s.SetRate(r)
+			s.SetCapacity(c)
+		}
+	}
+
+	d.mu.Lock()
+	d.targets = append(d.targets, func(n int) {
+		// backends not able to range over their limiters only rescale the new ones
+		_ = cb.Range(context.Background(), func(_ string, l krakendrate.Limiter) bool {
+			scale(l, n)
+			return true
+		})
+	})
+	d.mu.Unlock()
+
+	return krakendrate.NewTypedLimiterStore(backend, func() krakendrate.Limiter {
+		l := builder()
+		scale(l, d.Size())
+		return l
+	})
+}
+
+// divide returns the share of a node of the cluster-wide rate and capacity. The capacity is never
+// lower than 1
+func divide(rate float64, capacity uint64, n int) (float64, uint64) {
+	if n < 1 {
+		n = 1
+	}
+	c := capacity / uint64(n)
+	if c < 1 {
+		c = 1
+	}
+	return rate / float64(n), c
+}
+
+func clusterSize(m Membership) int {
+	if n := m.Size(); n > 1 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+func TestNewStatic(t *testing.T) {
+	if n := NewStatic([]string{"10.0.0.2:7946", "10.0.0.3:7946"}).Size(); n != 3 {
+		t.Errorf("unexpected size: %d", n)
+	}
+	if n := NewStatic(nil).Size(); n != 1 {
+		t.Errorf("unexpected size: %d", n)
+	}
+}
+
+func TestDivider_Bucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &fakeMembership{}
+	m.size.Store(4)
+	d := NewDivider(ctx, m, time.Hour)
+
+	tb := krakendrate.NewTokenBucket(0.001, 100)
+	d.Bucket(tb, 0.001, 100)
+	if st := tb.State(); st.Limit != 25 || st.Remaining != 25 {
+		t.Errorf("unexpected state with 4 nodes: %+v", st)
+	}
+
+	m.size.Store(2)
+	d.Refresh()
+	if st := tb.State(); st.Limit != 50 || st.Remaining != 50 {
+		t.Errorf("unexpected state with 2 nodes: %+v", st)
+	}
+	if d.Size() != 2 {
+		t.Errorf("unexpected size: %d", d.Size())
+	}
+}
+
+func TestDivider_WarmUpBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &fakeMembership{}
+	m.size.Store(4)
+	d := NewDivider(ctx, m, time.Hour)
+
+	tb := &fakeWarmUpBucket{}
+	d.WarmUpBucket(tb, 40, 20, 100)
+	if tb.rate != 10 || tb.cold != 5 || tb.capacity != 25 {
+		t.Errorf("unexpected values with 4 nodes: %+v", tb)
+	}
+
+	m.size.Store(2)
+	d.Refresh()
+	if tb.rate != 20 || tb.cold != 10 || tb.capacity != 50 {
+		t.Errorf("unexpected values with 2 nodes: %+v", tb)
+	}
+}
+
+type fakeWarmUpBucket struct {
+	rate, cold float64
+	capacity   uint64
+}
+
+func (f *fakeWarmUpBucket) SetRate(r float64)     { f.rate = r }
+func (f *fakeWarmUpBucket) SetColdRate(r float64) { f.cold = r }
+func (f *fakeWarmUpBucket) SetCapacity(c uint64)  { f.capacity = c }
+
+func TestDivider_Store(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &fakeMembership{}
+	m.size.Store(2)
+	d := NewDivider(ctx, m, time.Hour)
+	backend := krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute)
+	store := d.Store(backend, func() krakendrate.Limiter {
+		return krakendrate.NewTokenBucket(0.001, 10)
+	}, 0.001, 10)
+
+	for i := 0; i < 5; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("every node of a cluster of 2 should accept half of the capacity")
+	}
+
+	// a node leaves, so the existing limiters get its share
+	m.size.Store(1)
+	d.Refresh()
+	if st := store("a").(krakendrate.StatefulLimiter).State(); st.Limit != 10 {
+		t.Errorf("the existing limiters should be rescaled: %+v", st)
+	}
+	if st := store("b").(krakendrate.StatefulLimiter).State(); st.Limit != 10 || st.Remaining != 10 {
+		t.Errorf("the new limiters should use the current size: %+v", st)
+	}
+}
+
+func TestNewDivider_polling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &fakeMembership{}
+	m.size.Store(1)
+	d := NewDivider(ctx, m, 5*time.Millisecond)
+	m.size.Store(3)
+
+	deadline := time.Now().Add(time.Second)
+	for d.Size() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if d.Size() != 3 {
+		t.Errorf("the divider should poll the membership. size: %d", d.Size())
+	}
+}
+
+type fakeMembership struct {
+	size atomic.Int64
+}
+
+func (f *fakeMembership) Size() int {
+	return int(f.size.Load())
+}
@@ -0,0 +1,313 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heartbeatPrefix identifies the heartbeat packets
+var heartbeatPrefix = []byte("krakend-ratelimit-hb:")
+
+// heartbeatExt is the extension of the heartbeat files
+const heartbeatExt = ".hb"
+
+// ErrNoHeartbeatDir is the error returned when creating a file heartbeat without a directory
+var ErrNoHeartbeatDir = errors.New("cluster: no heartbeat directory")
+
+// HeartbeatConfig defines a membership based on UDP heartbeats
+type HeartbeatConfig struct {
+	// Bind is the UDP address where the node receives the heartbeats of its peers
+	Bind string
+	// Peers are the UDP addresses of the rest of the nodes
+	Peers []string
+	// Interval is the time between two heartbeats. Defaults to 1s
+	Interval time.Duration
+	// TTL is the time after the last heartbeat of a peer when it is considered dead. Defaults
+	// to three intervals
+	TTL time.Duration
+}
+
+// Heartbeat is a Membership sending UDP heartbeats to a static list of peers and counting the
+// ones heard during the TTL. The heartbeats coming from other addresses are ignored, so the size
+// never exceeds the number of peers plus the node itself
+type Heartbeat struct {
+	conn     *net.UDPConn
+	peers    []*net.UDPAddr
+	id       string
+	interval time.Duration
+	ttl      time.Duration
+	seen     map[string]time.Time
+	mu       *sync.Mutex
+	stop     *sync.Once
+}
+
+// NewHeartbeat returns a Membership listening to the heartbeats of its peers and sending its own
+// ones until the context is cancelled or it is closed
+func NewHeartbeat(ctx context.Context, cfg HeartbeatConfig) (*Heartbeat, error) {
+	cfg.Interval, cfg.TTL = heartbeatTimes(cfg.Interval, cfg.TTL)
+	addr, err := net.ResolveUDPAddr("udp", cfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]*net.UDPAddr, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		peer, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Heartbeat{
+		conn:     conn,
+		peers:    peers,
+		id:       nodeID(),
+		interval: cfg.Interval,
+		ttl:      cfg.TTL,
+		seen:     map[string]time.Time{},
+		mu:       new(sync.Mutex),
+		stop:     new(sync.Once),
+	}
+	go h.receive()
+	go func() {
+		t := time.NewTicker(h.interval)
+		defer t.Stop()
+		h.beat()
+		for {
+			select {
+			case <-ctx.Done():
+				h.Close()
+				return
+			case <-t.C:
+				if !h.beat() {
+					return
+				}
+			}
+		}
+	}()
+	return h, nil
+}
+
+// Addr returns the address where the node receives the heartbeats of its peers
+func (h *Heartbeat) Addr() net.Addr {
+	return h.conn.LocalAddr()
+}
+
+// Size implements the Membership interface
+func (h *Heartbeat) Size() int {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 1
+	for peer, last := range h.seen {
+		if now.Sub(last) > h.ttl {
+			delete(h.seen, peer)
+			continue
+		}
+		n++
+	}
+	return min(n, len(h.peers)+1)
+}
+
+// Close stops sending and receiving heartbeats, so the peers consider the node dead once the
+// TTL expires
+func (h *Heartbeat) Close() error {
+	var err error
+	h.stop.Do(func() {
+		err = h.conn.Close()
+	})
+	return err
+}
+
+// beat sends a heartbeat to every peer. It returns false once the node is closed
+func (h *Heartbeat) beat() bool {
+	msg := append(append([]byte(nil), heartbeatPrefix...), h.id...)
+	for _, p := range h.peers {
+		if _, err := h.conn.WriteToUDP(msg, p); errors.Is(err, net.ErrClosed) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Heartbeat) receive() {
+	buf := make([]byte, 512)
+	for {
+		size, addr, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		id, ok := bytes.CutPrefix(buf[:size], heartbeatPrefix)
+		if !ok || len(id) == 0 || string(id) == h.id {
+			continue
+		}
+		peer, ok := h.peer(addr)
+		if !ok {
+			continue
+		}
+		h.mu.Lock()
+		h.seen[peer] = time.Now()
+		h.mu.Unlock()
+	}
+}
+
+// peer returns the configured peer with the address, if any
+func (h *Heartbeat) peer(addr *net.UDPAddr) (string, bool) {
+	for _, p := range h.peers {
+		if p.Port == addr.Port && p.IP.Equal(addr.IP) {
+			return p.String(), true
+		}
+	}
+	return "", false
+}
+
+// FileHeartbeatConfig defines a membership based on heartbeat files in a shared directory
+type FileHeartbeatConfig struct {
+	// Dir is the directory shared by all the nodes
+	Dir string
+	// ID identifies the node. Defaults to a random one
+	ID string
+	// Interval is the time between two updates of the heartbeat file. Defaults to 1s
+	Interval time.Duration
+	// TTL is the time after the last update of a heartbeat file when its node is considered
+	// dead. Defaults to three intervals
+	TTL time.Duration
+}
+
+// FileHeartbeat is a Membership touching a heartbeat file in a directory shared by all the nodes,
+// like a shared volume, and counting the files updated during the TTL
+type FileHeartbeat struct {
+	dir    string
+	path   string
+	ttl    time.Duration
+	closed bool
+	done   chan struct{}
+	mu     *sync.Mutex
+}
+
+// NewFileHeartbeat returns a Membership updating its heartbeat file until the context is cancelled
+// or it is closed
+func NewFileHeartbeat(ctx context.Context, cfg FileHeartbeatConfig) (*FileHeartbeat, error) {
+	if cfg.Dir == "" {
+		return nil, ErrNoHeartbeatDir
+	}
+	cfg.Interval, cfg.TTL = heartbeatTimes(cfg.Interval, cfg.TTL)
+	if cfg.ID == "" {
+		cfg.ID = nodeID()
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	h := &FileHeartbeat{
+		dir:  cfg.Dir,
+		path: filepath.Join(cfg.Dir, filepath.Base(cfg.ID)+heartbeatExt),
+		ttl:  cfg.TTL,
+		done: make(chan struct{}),
+		mu:   new(sync.Mutex),
+	}
+	if err := h.beat(); err != nil {
+		return nil, err
+	}
+	go func() {
+		t := time.NewTicker(cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				h.Close()
+				return
+			case <-h.done:
+				return
+			case <-t.C:
+				// a failed update is retried on the next tick
+				_ = h.beat()
+			}
+		}
+	}()
+	return h, nil
+}
+
+// Size implements the Membership interface. The local node is always counted
+func (h *FileHeartbeat) Size() int {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return 1
+	}
+	now := time.Now()
+	self := filepath.Base(h.path)
+	n := 1
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), heartbeatExt) || e.Name() == self {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) > h.ttl {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// Close stops updating the heartbeat file and removes it, so the rest of the nodes stop counting
+// the local one
+func (h *FileHeartbeat) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	close(h.done)
+	return os.Remove(h.path)
+}
+
+func (h *FileHeartbeat) beat() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(h.path, now, now); err == nil {
+		return nil
+	}
+	return os.WriteFile(h.path, []byte(now.UTC().Format(time.RFC3339)), 0o644)
+}
+
+func heartbeatTimes(interval, ttl time.Duration) (time.Duration, time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if ttl <= 0 {
+		ttl = 3 * interval
+	}
+	return interval, ttl
+}
+
+// nodeID returns a random identifier for the local node
+func nodeID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrs := make([]string, 3)
+	for i := range addrs {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = conn.LocalAddr().String()
+		conn.Close()
+	}
+
+	nodes := make([]*Heartbeat, 3)
+	for i := range nodes {
+		var peers []string
+		for j, a := range addrs {
+			if i != j {
+				peers = append(peers, a)
+			}
+		}
+		h, err := NewHeartbeat(ctx, HeartbeatConfig{
+			Bind:     addrs[i],
+			Peers:    peers,
+			Interval: 10 * time.Millisecond,
+			TTL:      50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		nodes[i] = h
+	}
+
+	waitForSize(t, nodes[0], 3)
+	nodes[2].Close()
+	waitForSize(t, nodes[0], 2)
+	waitForSize(t, nodes[1], 2)
+}
+
+func TestHeartbeat_ignoresUnknownPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := NewHeartbeat(ctx, HeartbeatConfig{Bind: "127.0.0.1:0", Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// the rest of the nodes send heartbeats to a, but they are not peers of it
+	for i := 0; i < 3; i++ {
+		h, err := NewHeartbeat(ctx, HeartbeatConfig{
+			Bind:     "127.0.0.1:0",
+			Peers:    []string{a.Addr().String()},
+			Interval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if size := a.Size(); size != 1 {
+		t.Errorf("the heartbeats of unknown nodes should be ignored. size: %d", size)
+	}
+}
+
+func TestFileHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	cfg := FileHeartbeatConfig{Dir: dir, Interval: 10 * time.Millisecond, TTL: time.Minute}
+	a, err := NewFileHeartbeat(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	cfg.ID = "node-b"
+	b, err := NewFileHeartbeat(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale heartbeat and unrelated files are not counted
+	stale := filepath.Join(dir, "node-c"+heartbeatExt)
+	if err := os.WriteFile(stale, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := a.Size(); n != 2 {
+		t.Errorf("unexpected size: %d", n)
+	}
+	if err := b.Close(); err != nil {
+		t.Error(err)
+	}
+	if n := a.Size(); n != 1 {
+		t.Errorf("unexpected size after closing a node: %d", n)
+	}
+}
+
+func TestNewFileHeartbeat_noDir(t *testing.T) {
+	if _, err := NewFileHeartbeat(context.Background(), FileHeartbeatConfig{}); err != ErrNoHeartbeatDir {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func waitForSize(t *testing.T, m Membership, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if m.Size() == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("unexpected size. have: %d, want: %d", m.Size(), want)
+}
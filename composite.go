@@ -0,0 +1,100 @@
+package krakendrate
+
+import (
+	"sync"
+)
+
+// NewCompositeLimiter returns a limiter allowing a request only if all the received limiters allow it
+func NewCompositeLimiter(limiters ...Limiter) *CompositeLimiter {
+	return &CompositeLimiter{
+		limiters: limiters,
+		mu:       new(sync.Mutex),
+	}
+}
+
+// NewCompositeLimiterBuilder returns a LimiterBuilderFn creating composite limiters with a
+// limiter from each one of the received builders. The values built not implementing the Limiter
+// interface reject every request
+func NewCompositeLimiterBuilder(builders ...LimiterBuilderFn) LimiterBuilderFn {
+	return func() interface{} {
+		limiters := make([]Limiter, len(builders))
+		for i, b := range builders {
+			limiters[i] = asLimiter(b())
+		}
+		return NewCompositeLimiter(limiters...)
+	}
+}
+
+// CompositeLimiter combines several limiters, so a request is only allowed if all of them allow
+// it. The limiters are checked in order and, when one of them rejects the request, the tokens
+// taken from the previous ones are refunded. Limiters not implementing the RefundableLimiter
+// interface can not be rolled back, so they should be placed at the end of the list.
+type CompositeLimiter struct {
+	limiters []Limiter
+	mu       *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state of
+// all the limiters if the request can be processed
+func (c *CompositeLimiter) Allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, l := range c.limiters {
+		if l.Allow() {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if r, ok := c.limiters[j].(RefundableLimiter); ok {
+				r.Refund(1)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Refund gives n tokens back to all the limiters
+func (c *CompositeLimiter) Refund(n uint64) {
+	c.mu.Lock()
+	for _, l := range c.limiters {
+		if r, ok := l.(RefundableLimiter); ok {
+			r.Refund(n)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Charge takes n tokens from all the limiters implementing the ChargeableLimiter interface
+func (c *CompositeLimiter) Charge(n uint64) {
+	c.mu.Lock()
+	for _, l := range c.limiters {
+		if cl, ok := l.(ChargeableLimiter); ok {
+			cl.Charge(n)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// State returns the state of the most restrictive limiter: the one with less remaining requests
+// or, in case of a tie, the one taking longer to accept a new request
+func (c *CompositeLimiter) State() LimiterState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res LimiterState
+	found := false
+	for _, l := range c.limiters {
+		sl, ok := l.(StatefulLimiter)
+		if !ok {
+			continue
+		}
+		st := sl.State()
+		if !found || st.Remaining < res.Remaining ||
+			(st.Remaining == res.Remaining && st.RetryAfter > res.RetryAfter) {
+			res = st
+			found = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompositeLimiter(t *testing.T) {
+	clk := newTestClock()
+	perSecond := NewTokenBucketWithClock(2, 2, clk)
+	perMinute := NewSlidingWindowLogWithClock(3, time.Minute, clk)
+	perDay := NewFixedWindowWithClock(4, 24*time.Hour, clk)
+	c := NewCompositeLimiter(perSecond, perMinute, perDay)
+
+	for i := 0; i < 2; i++ {
+		if !c.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if c.Allow() {
+		t.Error("the 3rd request should be rejected by the per second limit")
+	}
+
+	clk.Add(time.Second)
+	if !c.Allow() {
+		t.Error("the 3rd request should be allowed after a second")
+	}
+	if c.Allow() {
+		t.Error("the 4th request should be rejected by the per minute limit")
+	}
+	// the rejection of the per minute limiter must not consume tokens of the per second one
+	if st := perSecond.State(); st.Remaining != 1 {
+		t.Errorf("the token of the rejected request was not refunded: %+v", st)
+	}
+
+	clk.Add(time.Minute)
+	if !c.Allow() {
+		t.Error("the 4th request should be allowed after a minute")
+	}
+	if c.Allow() {
+		t.Error("the 5th request should be rejected by the per day limit")
+	}
+	if st := perSecond.State(); st.Remaining != 2 {
+		t.Errorf("the token of the rejected request was not refunded: %+v", st)
+	}
+	if st := perMinute.State(); st.Remaining != 2 {
+		t.Errorf("the request rejected by the per day limit was not refunded: %+v", st)
+	}
+
+	if st := c.State(); st.Limit != 4 || st.Remaining != 0 {
+		t.Errorf("the state should be the one of the per day limiter: %+v", st)
+	}
+}
+
+func TestNewCompositeLimiterBuilder(t *testing.T) {
+	clk := newTestClock()
+	store := NewLimiterFromBackendAndBuilder(NewMemoryBackend(t.Context(), time.Minute),
+		NewCompositeLimiterBuilder(
+			NewTokenBucketBuilder(10, 10, 10, clk),
+			NewFixedWindowBuilder(1, time.Minute, clk),
+		))
+
+	if !store("a").Allow() {
+		t.Error("the first request of a should be allowed")
+	}
+	if store("a").Allow() {
+		t.Error("the second request of a should be rejected")
+	}
+	if !store("b").Allow() {
+		t.Error("the first request of b should be allowed")
+	}
+}
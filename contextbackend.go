@@ -0,0 +1,117 @@
+package krakendrate
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnsupportedOperation is the error returned by the backends not supporting an operation
+var ErrUnsupportedOperation = errors.New("operation not supported by the backend")
+
+// ContextBackend is the interface of the persistence layers able to report their failures
+type ContextBackend = TypedContextBackend[interface{}]
+
+// TypedContextBackend is the interface of a persistence layer storing values of type T, aware of
+// the context of the request and able to report its failures, so it can be implemented by remote
+// or persistent stores
+type TypedContextBackend[T any] interface {
+	// LoadContext returns the value stored for the key or, if there is none, it stores and
+	// returns the value created by f
+	LoadContext(ctx context.Context, key string, f func() T) (T, error)
+	// StoreContext sets the value for the key
+	StoreContext(ctx context.Context, key string, v T) error
+	// Delete removes the key and its value, if any
+	Delete(ctx context.Context, key string) error
+	// Range calls f for every key and value stored until f returns false
+	Range(ctx context.Context, f func(key string, v T) bool) error
+	// Len returns the number of keys stored
+	Len(ctx context.Context) (int, error)
+}
+
+// NewBackendFromContextBackend returns a TypedBackend wrapping the received TypedContextBackend,
+// for the callers of the previous API. Since the Load method can not report errors, it fails open:
+// when the wrapped backend fails, it returns a fresh value created by f without storing it, so
+// every request gets a new limiter and the limits are not enforced until the backend recovers.
+// Use NewBackendFromContextBackendWithFallback to observe the errors or to fail closed.
+func NewBackendFromContextBackend[T any](b TypedContextBackend[T]) TypedBackend[T] {
+	return NewBackendFromContextBackendWithFallback(b, nil)
+}
+
+// NewBackendFromContextBackendWithFallback returns a TypedBackend wrapping the received
+// TypedContextBackend. When the wrapped backend fails, Load returns the value returned by the
+// fallback for the key, the error and the builder f. A fallback returning a limiter that rejects
+// every request makes the backend fail closed. A nil fallback behaves like the one of
+// NewBackendFromContextBackend.
+func NewBackendFromContextBackendWithFallback[T any](b TypedContextBackend[T], fallback func(key string, err error, f func() T) T) TypedBackend[T] {
+	if fallback == nil {
+		fallback = func(_ string, _ error, f func() T) T {
+			return f()
+		}
+	}
+	return contextBackendShim[T]{b: b, fallback: fallback}
+}
+
+type contextBackendShim[T any] struct {
+	b        TypedContextBackend[T]
+	fallback func(string, error, func() T) T
+}
+
+// Load implements the TypedBackend interface
+func (s contextBackendShim[T]) Load(key string, f func() T) T {
+	v, err := s.b.LoadContext(context.Background(), key, f)
+	if err != nil {
+		return s.fallback(key, err, f)
+	}
+	return v
+}
+
+// Store implements the TypedBackend interface
+func (s contextBackendShim[T]) Store(key string, v T) error {
+	return s.b.StoreContext(context.Background(), key, v)
+}
+
+// NewContextBackend returns a TypedContextBackend wrapping the received TypedBackend. The backends
+// already implementing the TypedContextBackend interface are returned as they are, and the rest of
+// them return ErrUnsupportedOperation from the operations not defined by the TypedBackend interface.
+func NewContextBackend[T any](b TypedBackend[T]) TypedContextBackend[T] {
+	if cb, ok := b.(TypedContextBackend[T]); ok {
+		return cb
+	}
+	return backendShim[T]{b: b}
+}
+
+type backendShim[T any] struct {
+	b TypedBackend[T]
+}
+
+// LoadContext implements the TypedContextBackend interface
+func (s backendShim[T]) LoadContext(ctx context.Context, key string, f func() T) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	return s.b.Load(key, f), nil
+}
+
+// StoreContext implements the TypedContextBackend interface
+func (s backendShim[T]) StoreContext(ctx context.Context, key string, v T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.b.Store(key, v)
+}
+
+// Delete implements the TypedContextBackend interface
+func (backendShim[T]) Delete(context.Context, string) error {
+	return ErrUnsupportedOperation
+}
+
+// Range implements the TypedContextBackend interface
+func (backendShim[T]) Range(context.Context, func(string, T) bool) error {
+	return ErrUnsupportedOperation
+}
+
+// Len implements the TypedContextBackend interface
+func (backendShim[T]) Len(context.Context) (int, error) {
+	return 0, ErrUnsupportedOperation
+}
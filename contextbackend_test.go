@@ -0,0 +1,127 @@
+package krakendrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestContextBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		f    func(context.Context) ContextBackend
+	}{
+		{name: "memory", f: func(ctx context.Context) ContextBackend { return NewMemoryBackend(ctx, time.Minute) }},
+		{name: "sharded", f: func(ctx context.Context) ContextBackend {
+			return NewShardedMemoryBackend(ctx, 16, time.Minute, PseudoFNV64a)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testContextBackend(t, tc.f)
+		})
+	}
+}
+
+func testContextBackend(t *testing.T, f func(context.Context) ContextBackend) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := f(ctx)
+
+	for i := 0; i < 100; i++ {
+		if err := b.StoreContext(ctx, fmt.Sprintf("key-%d", i), i); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if v, err := b.LoadContext(ctx, "key-42", func() interface{} { return -1 }); err != nil || v != 42 {
+		t.Errorf("unexpected result. value: %v, err: %v", v, err)
+	}
+	if err := b.Delete(ctx, "key-42"); err != nil {
+		t.Error(err)
+	}
+	if l, err := b.Len(ctx); err != nil || l != 99 {
+		t.Errorf("unexpected length: %d, err: %v", l, err)
+	}
+
+	sum := 0
+	if err := b.Range(ctx, func(_ string, v interface{}) bool {
+		sum += v.(int)
+		return true
+	}); err != nil {
+		t.Error(err)
+	}
+	if sum != 4950-42 {
+		t.Errorf("unexpected sum of the values: %d", sum)
+	}
+
+	visited := 0
+	if err := b.Range(ctx, func(string, interface{}) bool {
+		visited++
+		return visited < 10
+	}); err != nil || visited != 10 {
+		t.Errorf("the range should stop after 10 keys. visited: %d, err: %v", visited, err)
+	}
+
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	reqCancel()
+	if _, err := b.LoadContext(reqCtx, "key-1", func() interface{} { return -1 }); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type erroredContextBackend struct {
+	backendShim[interface{}]
+}
+
+func (erroredContextBackend) LoadContext(context.Context, string, func() interface{}) (interface{}, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestNewBackendFromContextBackend(t *testing.T) {
+	b := NewBackendFromContextBackend[interface{}](erroredContextBackend{})
+	if v := b.Load("key", func() interface{} { return 1 }); v != 1 {
+		t.Errorf("a fresh value should be returned when the backend fails: %v", v)
+	}
+
+	var failures int
+	b = NewBackendFromContextBackendWithFallback[interface{}](erroredContextBackend{}, func(key string, err error, _ func() interface{}) interface{} {
+		if key != "key" || err == nil {
+			t.Errorf("unexpected fallback call. key: %s, err: %v", key, err)
+		}
+		failures++
+		return 0
+	})
+	if v := b.Load("key", func() interface{} { return 1 }); v != 0 || failures != 1 {
+		t.Errorf("the value of the fallback should be returned when the backend fails: %v", v)
+	}
+}
+
+type legacyBackend struct {
+	Backend
+}
+
+func TestNewContextBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mb := NewMemoryBackend(ctx, time.Minute)
+	if cb := NewContextBackend[interface{}](mb); cb != ContextBackend(mb) {
+		t.Error("the memory backend should be returned as it is")
+	}
+
+	cb := NewContextBackend[interface{}](legacyBackend{Backend: mb})
+	if err := cb.StoreContext(ctx, "key", 1); err != nil {
+		t.Error(err)
+	}
+	if v, err := cb.LoadContext(ctx, "key", nil); err != nil || v != 1 {
+		t.Errorf("unexpected result. value: %v, err: %v", v, err)
+	}
+	if err := cb.Delete(ctx, "key"); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := cb.Len(ctx); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package krakendrate
+
+import (
+	"sync"
+	"time"
+)
+
+// NewFixedWindow returns a fixed window limiter allowing up to limit requests per window,
+// using the default clock
+func NewFixedWindow(limit uint64, window time.Duration) *FixedWindow {
+	return NewFixedWindowWithClock(limit, window, nil)
+}
+
+// NewFixedWindowWithClock returns a fixed window limiter allowing up to limit requests per
+// window, using the received clock
+func NewFixedWindowWithClock(limit uint64, window time.Duration, c Clock) *FixedWindow {
+	return NewFixedWindowBuilder(limit, window, c)().(*FixedWindow)
+}
+
+// NewFixedWindowBuilder returns a LimiterBuilderFn creating fixed window limiters with the
+// given limit, window and clock.
+//
+// The windows are aligned to multiples of the window duration since the zero time, so
+// windows of a second, a minute or an hour reset at the top of the second, minute or hour,
+// and windows of 24 hours reset at UTC midnight.
+func NewFixedWindowBuilder(limit uint64, window time.Duration, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = time.Second
+	}
+
+	return func() interface{} {
+		return &FixedWindow{
+			limit:       limit,
+			window:      window,
+			clock:       clk,
+			windowStart: clk.Now().Truncate(window),
+			mu:          new(sync.Mutex),
+		}
+	}
+}
+
+// FixedWindow is an implementation of the fixed window pattern with windows aligned to
+// wall-clock boundaries
+type FixedWindow struct {
+	limit       uint64
+	window      time.Duration
+	clock       Clock
+	windowStart time.Time
+	count       uint64
+	mu          *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (f *FixedWindow) Allow() bool {
+	f.mu.Lock()
+	r := f.canConsume()
+	f.mu.Unlock()
+	return r
+}
+
+// NextReset returns the instant when the current window ends and the quota is restored
+func (f *FixedWindow) NextReset() time.Time {
+	f.mu.Lock()
+	f.rotate(f.clock.Now())
+	r := f.windowStart.Add(f.window)
+	f.mu.Unlock()
+	return r
+}
+
+// Refund gives n requests back to the current window
+func (f *FixedWindow) Refund(n uint64) {
+	f.mu.Lock()
+	if n > f.count {
+		n = f.count
+	}
+	f.count -= n
+	f.mu.Unlock()
+}
+
+// State returns the current state of the limiter
+func (f *FixedWindow) State() LimiterState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.clock.Now()
+	f.rotate(n)
+	st := LimiterState{
+		Limit:     f.limit,
+		Remaining: f.limit - f.count,
+	}
+	if f.count > 0 {
+		st.Reset = f.windowStart.Add(f.window).Sub(n)
+	}
+	if st.Remaining == 0 {
+		st.RetryAfter = st.Reset
+	}
+	return st
+}
+
+func (f *FixedWindow) canConsume() bool {
+	f.rotate(f.clock.Now())
+	if f.count >= f.limit {
+		return false
+	}
+	f.count++
+	return true
+}
+
+// rotate resets the counter if the instant n is out of the current window
+func (f *FixedWindow) rotate(n time.Time) {
+	if start := n.Truncate(f.window); start.After(f.windowStart) {
+		f.windowStart = start
+		f.count = 0
+	}
+}
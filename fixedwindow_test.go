@@ -0,0 +1,71 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixedWindow(t *testing.T) {
+	clk := newTestClock()
+	clk.Set(time.Date(2024, 1, 1, 10, 59, 30, 0, time.UTC))
+	fw := NewFixedWindowWithClock(2, time.Hour, clk)
+
+	if reset := fw.NextReset(); !reset.Equal(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected reset time: %s", reset)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !fw.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if fw.Allow() {
+		t.Error("the 3rd request should be rejected")
+	}
+
+	// the window resets at the top of the hour, not one hour after the first request
+	clk.Add(30 * time.Second)
+	if !fw.Allow() {
+		t.Error("the first request of the new window should be allowed")
+	}
+	if reset := fw.NextReset(); !reset.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected reset time: %s", reset)
+	}
+}
+
+func TestFixedWindow_utcMidnight(t *testing.T) {
+	clk := newTestClock()
+	clk.Set(time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC))
+	fw := NewFixedWindowWithClock(1, 24*time.Hour, clk)
+
+	if !fw.Allow() {
+		t.Error("the first request should be allowed")
+	}
+	clk.Add(59 * time.Minute)
+	if fw.Allow() {
+		t.Error("the second request should be rejected before midnight")
+	}
+	clk.Add(time.Minute)
+	if !fw.Allow() {
+		t.Error("the request should be allowed after UTC midnight")
+	}
+}
+
+func TestFixedWindow_State(t *testing.T) {
+	clk := newTestClock()
+	clk.Set(time.Date(2024, 1, 1, 10, 0, 40, 0, time.UTC))
+	fw := NewFixedWindowWithClock(2, time.Minute, clk)
+
+	if st := fw.State(); st != (LimiterState{Limit: 2, Remaining: 2}) {
+		t.Errorf("unexpected state of an unused window: %+v", st)
+	}
+	fw.Allow()
+	if st := fw.State(); st != (LimiterState{Limit: 2, Remaining: 1, Reset: 20 * time.Second}) {
+		t.Errorf("unexpected state: %+v", st)
+	}
+	fw.Allow()
+	want := LimiterState{Limit: 2, RetryAfter: 20 * time.Second, Reset: 20 * time.Second}
+	if st := fw.State(); st != want {
+		t.Errorf("unexpected state of an exhausted window: %+v", st)
+	}
+}
@@ -0,0 +1,110 @@
+package krakendrate
+
+import (
+	"sync"
+	"time"
+)
+
+// NewGCRA returns a GCRA limiter with the given rate and burst capacity, using the default clock
+func NewGCRA(rate float64, capacity uint64) *GCRA {
+	return NewGCRAWithClock(rate, capacity, nil)
+}
+
+// NewGCRAWithClock returns a GCRA limiter with the given rate, burst capacity and clock
+func NewGCRAWithClock(rate float64, capacity uint64, c Clock) *GCRA {
+	return NewGCRABuilder(rate, capacity, c)().(*GCRA)
+}
+
+// NewGCRABuilder returns a LimiterBuilderFn creating GCRA limiters with the given rate,
+// burst capacity and clock
+func NewGCRABuilder(rate float64, capacity uint64, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	if rate < 1e-9 {
+		rate = 1e-9
+	}
+	emissionInterval := time.Duration(int64(1e9 / rate))
+	tolerance := time.Duration(capacity) * emissionInterval
+
+	return func() interface{} {
+		return &GCRA{
+			emissionInterval: emissionInterval,
+			tolerance:        tolerance,
+			clock:            clk,
+			mu:               new(sync.Mutex),
+		}
+	}
+}
+
+// GCRA is an implementation of the generic cell rate algorithm. It is equivalent to a
+// token bucket, but it only keeps the theoretical arrival time (TAT) of the next request
+// instead of the amount of tokens and the time of the last refill.
+//
+// With a capacity of 1, the accepted requests are evenly spaced by the emission interval.
+type GCRA struct {
+	emissionInterval time.Duration
+	tolerance        time.Duration
+	clock            Clock
+	tat              time.Time
+	mu               *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (g *GCRA) Allow() bool {
+	ok, _ := g.AllowWithRetryAfter()
+	return ok
+}
+
+// AllowWithRetryAfter flags if the current request can be processed or not. If it can not, it
+// also returns the time to wait before the next request could be accepted
+func (g *GCRA) AllowWithRetryAfter() (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := g.clock.Now()
+	tat := g.tat
+	if tat.Before(n) {
+		tat = n
+	}
+	newTat := tat.Add(g.emissionInterval)
+
+	if allowAt := newTat.Add(-g.tolerance); n.Before(allowAt) {
+		return false, allowAt.Sub(n)
+	}
+
+	g.tat = newTat
+	return true, 0
+}
+
+// Refund gives n requests back to the limiter by moving the theoretical arrival time backwards
+func (g *GCRA) Refund(n uint64) {
+	g.mu.Lock()
+	g.tat = g.tat.Add(-time.Duration(n) * g.emissionInterval)
+	g.mu.Unlock()
+}
+
+// State returns the current state of the limiter
+func (g *GCRA) State() LimiterState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := g.clock.Now()
+	tat := g.tat
+	if tat.Before(n) {
+		tat = n
+	}
+	st := LimiterState{
+		Limit:     uint64(g.tolerance / g.emissionInterval),
+		Remaining: uint64((g.tolerance - tat.Sub(n)) / g.emissionInterval),
+		Reset:     tat.Sub(n),
+	}
+	if st.Remaining == 0 {
+		st.RetryAfter = tat.Add(g.emissionInterval - g.tolerance).Sub(n)
+	}
+	return st
+}
@@ -0,0 +1,81 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	clk := newTestClock()
+	g := NewGCRAWithClock(10, 3, clk)
+
+	for i := 0; i < 3; i++ {
+		if !g.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	ok, retryAfter := g.AllowWithRetryAfter()
+	if ok {
+		t.Error("the 4th request should be rejected")
+	}
+	if retryAfter != 100*time.Millisecond {
+		t.Errorf("unexpected retry after: %s", retryAfter)
+	}
+
+	clk.Add(retryAfter)
+	if !g.Allow() {
+		t.Error("the request should be allowed after the retry after period")
+	}
+	if g.Allow() {
+		t.Error("the request should be rejected")
+	}
+
+	clk.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !g.Allow() {
+			t.Errorf("request #%d should be allowed after a long idle period", i)
+		}
+	}
+	if g.Allow() {
+		t.Error("the request should be rejected after consuming the burst")
+	}
+}
+
+func TestGCRA_evenlySpaced(t *testing.T) {
+	clk := newTestClock()
+	g := NewGCRAWithClock(4, 1, clk)
+
+	if !g.Allow() {
+		t.Error("the first request should be allowed")
+	}
+	for i := 0; i < 10; i++ {
+		clk.Add(200 * time.Millisecond)
+		if g.Allow() {
+			t.Errorf("request #%d should be rejected before the emission interval", i)
+		}
+		clk.Add(50 * time.Millisecond)
+		if !g.Allow() {
+			t.Errorf("request #%d should be allowed after the emission interval", i)
+		}
+	}
+}
+
+func TestGCRA_State(t *testing.T) {
+	clk := newTestClock()
+	g := NewGCRAWithClock(10, 3, clk)
+
+	if st := g.State(); st != (LimiterState{Limit: 3, Remaining: 3}) {
+		t.Errorf("unexpected state of an unused limiter: %+v", st)
+	}
+	g.Allow()
+	if st := g.State(); st != (LimiterState{Limit: 3, Remaining: 2, Reset: 100 * time.Millisecond}) {
+		t.Errorf("unexpected state: %+v", st)
+	}
+	g.Allow()
+	g.Allow()
+	clk.Add(30 * time.Millisecond)
+	want := LimiterState{Limit: 3, RetryAfter: 70 * time.Millisecond, Reset: 270 * time.Millisecond}
+	if st := g.State(); st != want {
+		t.Errorf("unexpected state of an exhausted limiter: %+v", st)
+	}
+}
@@ -0,0 +1,141 @@
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// protocolVersion is the first byte of every packet
+	protocolVersion byte = 2
+	// maxPacketSize keeps the packets under the usual MTU, so they are not fragmented
+	maxPacketSize = 1400
+	// macSize is the size of the signature appended to the packets when there is a shared secret
+	macSize = sha256.Size
+)
+
+// errMalformedPacket is the error returned when decoding a packet not following the protocol
+var errMalformedPacket = errors.New("gossip: malformed packet")
+
+// errInvalidSignature is the error returned when decoding a packet not signed with the shared secret
+var errInvalidSignature = errors.New("gossip: invalid signature")
+
+type delta struct {
+	key   string
+	value uint64
+}
+
+// message is the content of a decoded packet
+type message struct {
+	// seq is the sequence number of the packet, increasing with every packet sent by a node
+	seq    uint64
+	name   string
+	deltas []delta
+}
+
+// encode returns the packets with the deltas of a shard of the named store. Every packet starts
+// with the version of the protocol, a sequence number taken from next, the name of the store and
+// the shard, followed by the keys and their deltas, all of them prefixed by their length as
+// uvarints. If the secret is not empty, every packet ends with its HMAC-SHA256 signature, covering
+// the sequence number too
+func encode(name string, shard uint64, deltas map[string]uint64, next func() uint64, secret []byte) [][]byte {
+	header := binary.AppendUvarint(nil, uint64(len(name)))
+	header = append(header, name...)
+	header = binary.AppendUvarint(header, shard)
+	newPacket := func() []byte {
+		packet := binary.AppendUvarint([]byte{protocolVersion}, next())
+		return append(packet, header...)
+	}
+
+	limit := maxPacketSize
+	if len(secret) > 0 {
+		limit -= macSize
+	}
+
+	var packets [][]byte
+	packet := newPacket()
+	empty := len(packet)
+	for k, v := range deltas {
+		entry := binary.AppendUvarint(nil, uint64(len(k)))
+		entry = append(entry, k...)
+		entry = binary.AppendUvarint(entry, v)
+		if len(packet) > empty && len(packet)+len(entry) > limit {
+			packets = append(packets, sign(packet, secret))
+			packet = newPacket()
+			empty = len(packet)
+		}
+		packet = append(packet, entry...)
+	}
+	return append(packets, sign(packet, secret))
+}
+
+// sign appends the signature of the packet, if the secret is not empty
+func sign(packet, secret []byte) []byte {
+	if len(secret) == 0 {
+		return packet
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(packet)
+	return mac.Sum(packet)
+}
+
+// decode returns the message of the packet. If the secret is not empty, the packets without a
+// valid signature are rejected
+func decode(packet, secret []byte) (message, error) {
+	var m message
+	if len(secret) > 0 {
+		if len(packet) < macSize {
+			return m, errInvalidSignature
+		}
+		body := packet[:len(packet)-macSize]
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), packet[len(body):]) {
+			return m, errInvalidSignature
+		}
+		packet = body
+	}
+	if len(packet) == 0 || packet[0] != protocolVersion {
+		return m, errMalformedPacket
+	}
+	packet = packet[1:]
+	seq, size := binary.Uvarint(packet)
+	if size <= 0 {
+		return m, errMalformedPacket
+	}
+	packet = packet[size:]
+	name, packet, ok := readString(packet)
+	if !ok {
+		return m, errMalformedPacket
+	}
+	// the shard is only informative for the receiver
+	if _, size = binary.Uvarint(packet); size <= 0 {
+		return m, errMalformedPacket
+	}
+	packet = packet[size:]
+
+	var deltas []delta
+	for len(packet) > 0 {
+		var d delta
+		if d.key, packet, ok = readString(packet); !ok {
+			return m, errMalformedPacket
+		}
+		if d.value, size = binary.Uvarint(packet); size <= 0 {
+			return m, errMalformedPacket
+		}
+		packet = packet[size:]
+		deltas = append(deltas, d)
+	}
+	return message{seq: seq, name: name, deltas: deltas}, nil
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	l, size := binary.Uvarint(b)
+	if size <= 0 || uint64(len(b)-size) < l {
+		return "", nil, false
+	}
+	b = b[size:]
+	return string(b[:l]), b[l:], true
+}
@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, secret := range [][]byte{nil, []byte("s3cr3t")} {
+		testEncodeDecode(t, secret)
+	}
+}
+
+func testEncodeDecode(t *testing.T, secret []byte) {
+	deltas := map[string]uint64{}
+	for i := 0; i < 500; i++ {
+		deltas[fmt.Sprintf("client-%d", i)] = uint64(i + 1)
+	}
+
+	packets := encode("endpoint", 3, deltas, newSequence(1<<62), secret)
+	if len(packets) < 2 {
+		t.Errorf("the deltas should be split in several packets. got: %d", len(packets))
+	}
+
+	got := map[string]uint64{}
+	for i, p := range packets {
+		if len(p) > maxPacketSize {
+			t.Errorf("packet too big: %d bytes", len(p))
+		}
+		m, err := decode(p, secret)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if m.name != "endpoint" {
+			t.Errorf("unexpected store name: %q", m.name)
+		}
+		if m.seq != 1<<62+uint64(i)+1 {
+			t.Errorf("unexpected sequence number of the packet #%d: %d", i, m.seq)
+		}
+		for _, d := range m.deltas {
+			got[d.key] += d.value
+		}
+	}
+	if len(got) != len(deltas) {
+		t.Errorf("unexpected number of keys: %d", len(got))
+	}
+	for k, v := range deltas {
+		if got[k] != v {
+			t.Errorf("unexpected delta for %s: %d", k, got[k])
+		}
+	}
+}
+
+func TestDecode_malformed(t *testing.T) {
+	valid := encode("endpoint", 0, map[string]uint64{"a": 1}, newSequence(0), nil)[0]
+	for i, p := range [][]byte{
+		nil,
+		{42},
+		{protocolVersion, 200},
+		{protocolVersion, 1, 200},
+		valid[:len(valid)-1],
+		append(append([]byte(nil), valid...), 5, 'a'),
+	} {
+		if _, err := decode(p, nil); err != errMalformedPacket {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestDecode_invalidSignature(t *testing.T) {
+	secret := []byte("s3cr3t")
+	signed := encode("endpoint", 0, map[string]uint64{"a": 1}, newSequence(0), secret)[0]
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-macSize-1]++
+	// the sequence number is signed too
+	resequenced := append([]byte(nil), signed...)
+	resequenced[1]++
+
+	for i, p := range [][]byte{
+		encode("endpoint", 0, map[string]uint64{"a": 1}, newSequence(0), nil)[0],
+		encode("endpoint", 0, map[string]uint64{"a": 1}, newSequence(0), []byte("other"))[0],
+		tampered,
+		resequenced,
+	} {
+		if _, err := decode(p, secret); err != errInvalidSignature {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+// newSequence returns a generator of consecutive sequence numbers after the given one
+func newSequence(last uint64) func() uint64 {
+	return func() uint64 {
+		last++
+		return last
+	}
+}
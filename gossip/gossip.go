@@ -0,0 +1,434 @@
+// Package gossip synchronises the consumption of the client limiters between several gateway
+// nodes without an external datastore. Every node sends the usage accounted by its limiters to
+// its peers over UDP, and the limiters of the peers charge it, so all of them converge to the
+// cluster-wide consumption of every key.
+package gossip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+// ErrNoBindAddress is the error returned when creating a node without an address to listen to
+var ErrNoBindAddress = errors.New("gossip: no bind address")
+
+// ErrStoreConflict is the error returned when registering a store with the name of another one
+// with a different fingerprint
+var ErrStoreConflict = errors.New("gossip: the store is already registered with another fingerprint")
+
+// Config defines a gossip node
+type Config struct {
+	// Bind is the UDP address where the node receives the deltas of its peers
+	Bind string
+	// Peers are the UDP addresses of the rest of the nodes of the cluster
+	Peers []string
+	// Interval is the time between two flushes of the local deltas. Defaults to 100ms
+	Interval time.Duration
+	// Shards is the number of partitions of the pending deltas of every store. It should match
+	// the number of shards of the backends, so both use the same key layout. Defaults to 1
+	Shards uint64
+	// Secret is the key shared by all the nodes to sign their packets with HMAC-SHA256. The
+	// packets without a valid signature are dropped. Empty means the packets are not signed
+	Secret string
+}
+
+// Node sends the usage of its limiters to its peers and applies the usage received from them.
+// The packets coming from addresses other than the peers are dropped, and so are the replayed
+// ones: every packet carries a sequence number, starting at the time the node was created, and
+// the packets already received or too old for the replay window of their sender are ignored.
+type Node struct {
+	conn     *net.UDPConn
+	interval time.Duration
+	shards   uint64
+	secret   []byte
+	peers    []*net.UDPAddr
+	stores   map[string]*store
+	seq      *atomic.Uint64
+	// windows are the replay windows of the senders. They are only used by the receiving
+	// goroutine
+	windows map[string]*replayWindow
+	mu      *sync.RWMutex
+	done    chan struct{}
+	stop    *sync.Once
+	wg      *sync.WaitGroup
+}
+
+// New returns a node listening to the bind address of the config. It flushes its deltas
+// periodically until the context is cancelled or the node is closed
+func New(ctx context.Context, cfg Config) (*Node, error) {
+	if cfg.Bind == "" {
+		return nil, ErrNoBindAddress
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 100 * time.Millisecond
+	}
+	if cfg.Shards < 1 {
+		cfg.Shards = 1
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		conn:     conn,
+		interval: cfg.Interval,
+		shards:   cfg.Shards,
+		secret:   []byte(cfg.Secret),
+		stores:   map[string]*store{},
+		seq:      new(atomic.Uint64),
+		windows:  map[string]*replayWindow{},
+		mu:       new(sync.RWMutex),
+		done:     make(chan struct{}),
+		stop:     new(sync.Once),
+		wg:       new(sync.WaitGroup),
+	}
+	if err := n.SetPeers(cfg.Peers); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// a restarted node keeps sending sequence numbers above the ones of its previous run, as long
+	// as its clock does not go back
+	n.seq.Store(uint64(time.Now().UnixNano()))
+
+	n.wg.Add(2)
+	go n.receive()
+	go n.flushLoop(ctx)
+	return n, nil
+}
+
+// Addr returns the address where the node receives the deltas of its peers
+func (n *Node) Addr() net.Addr {
+	return n.conn.LocalAddr()
+}
+
+// SetPeers replaces the list of peers receiving the deltas of the node
+func (n *Node) SetPeers(peers []string) error {
+	addrs := make([]*net.UDPAddr, 0, len(peers))
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	n.mu.Lock()
+	n.peers = addrs
+	n.mu.Unlock()
+	return nil
+}
+
+// Store returns a LimiterStore whose limiters share their usage with the stores of the peers
+// registered with the same name. The limiters are kept in the received backend and created with
+// the builder, and they must implement the krakendrate.ChargeableLimiter interface to account
+// the usage of the peers. The fingerprint identifies the limits of the store: registering the
+// same name again returns the existing store if the fingerprints match, or ErrStoreConflict
+// otherwise.
+func (n *Node) Store(name, fingerprint string, backend krakendrate.TypedBackend[krakendrate.Limiter], builder func() krakendrate.Limiter) (krakendrate.LimiterStore, error) {
+	n.mu.Lock()
+	s, ok := n.stores[name]
+	if !ok {
+		s = newStore(name, fingerprint, backend, builder, n.shards)
+		n.stores[name] = s
+	}
+	n.mu.Unlock()
+
+	if s.fingerprint != fingerprint {
+		return nil, ErrStoreConflict
+	}
+
+	return func(key string) krakendrate.Limiter {
+		return &Limiter{
+			Limiter: s.load(key),
+			key:     key,
+			store:   s,
+		}
+	}, nil
+}
+
+// Flush sends the pending deltas of all the stores to the peers
+func (n *Node) Flush() {
+	n.mu.RLock()
+	peers := n.peers
+	stores := make([]*store, 0, len(n.stores))
+	for _, s := range n.stores {
+		stores = append(stores, s)
+	}
+	n.mu.RUnlock()
+
+	for _, s := range stores {
+		for shard, p := range s.pending {
+			deltas := p.swap()
+			if len(deltas) == 0 || len(peers) == 0 {
+				continue
+			}
+			for _, packet := range encode(s.name, uint64(shard), deltas, n.nextSeq, n.secret) {
+				for _, peer := range peers {
+					// the gossip is best effort: the lost deltas are not sent again
+					_, _ = n.conn.WriteToUDP(packet, peer)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the node, flushing the pending deltas first
+func (n *Node) Close() error {
+	err := n.shutdown()
+	n.wg.Wait()
+	return err
+}
+
+func (n *Node) shutdown() error {
+	var err error
+	n.stop.Do(func() {
+		n.Flush()
+		close(n.done)
+		err = n.conn.Close()
+	})
+	return err
+}
+
+func (n *Node) flushLoop(ctx context.Context) {
+	defer n.wg.Done()
+	t := time.NewTicker(n.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = n.shutdown()
+			return
+		case <-n.done:
+			return
+		case <-t.C:
+			n.Flush()
+		}
+	}
+}
+
+func (n *Node) receive() {
+	defer n.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !n.isPeer(addr) {
+			continue
+		}
+		m, err := decode(buf[:size], n.secret)
+		if err != nil {
+			continue
+		}
+		w, ok := n.windows[addr.String()]
+		if !ok {
+			w = new(replayWindow)
+			n.windows[addr.String()] = w
+		}
+		if !w.accept(m.seq) {
+			continue
+		}
+		n.mu.RLock()
+		s, ok := n.stores[m.name]
+		n.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		for _, d := range m.deltas {
+			s.apply(d.key, d.value)
+		}
+	}
+}
+
+// nextSeq returns the sequence number of the next packet sent by the node
+func (n *Node) nextSeq() uint64 {
+	return n.seq.Add(1)
+}
+
+// isPeer flags if the address is one of the peers of the node
+func (n *Node) isPeer(addr *net.UDPAddr) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, p := range n.peers {
+		if p.Port == addr.Port && p.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayWindowSize is the number of sequence numbers tracked below the highest one received from a
+// sender, so the packets reordered by the network are not dropped
+const replayWindowSize = 64
+
+// replayWindow tracks the sequence numbers received from a sender, like the anti-replay windows of
+// IPsec: it keeps the highest one and a bitmap with the ones received below it
+type replayWindow struct {
+	last uint64
+	seen uint64
+}
+
+// accept flags if the sequence number has not been received yet and it is not too old, recording it
+func (w *replayWindow) accept(seq uint64) bool {
+	if seq > w.last {
+		if shift := seq - w.last; shift < replayWindowSize {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.last = seq
+		return true
+	}
+	diff := w.last - seq
+	if diff >= replayWindowSize {
+		return false
+	}
+	bit := uint64(1) << diff
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
+
+// Limiter wraps the limiters of a gossip store, recording the local usage so it can be sent to
+// the peers
+type Limiter struct {
+	krakendrate.Limiter
+	key   string
+	store *store
+}
+
+// Allow flags if the current request can be processed or not. The accepted requests are
+// recorded as usage of the key
+func (l *Limiter) Allow() bool {
+	if !l.Limiter.Allow() {
+		return false
+	}
+	l.store.record(l.key, 1)
+	return true
+}
+
+// Charge takes n tokens from the wrapped limiter and records them as usage of the key
+func (l *Limiter) Charge(n uint64) {
+	if c, ok := l.Limiter.(krakendrate.ChargeableLimiter); ok {
+		c.Charge(n)
+	}
+	l.store.record(l.key, n)
+}
+
+// Refund gives n tokens back to the wrapped limiter. The usage already sent to the peers is
+// not refunded
+func (l *Limiter) Refund(n uint64) {
+	if r, ok := l.Limiter.(krakendrate.RefundableLimiter); ok {
+		r.Refund(n)
+	}
+	l.store.unrecord(l.key, n)
+}
+
+// State returns the state of the wrapped limiter. A zero state is returned if it does not
+// implement the krakendrate.StatefulLimiter interface
+func (l *Limiter) State() krakendrate.LimiterState {
+	if sl, ok := l.Limiter.(krakendrate.StatefulLimiter); ok {
+		return sl.State()
+	}
+	return krakendrate.LimiterState{}
+}
+
+type store struct {
+	name        string
+	fingerprint string
+	backend     krakendrate.TypedBackend[krakendrate.Limiter]
+	builder     func() krakendrate.Limiter
+	pending     []*pendingShard
+}
+
+func newStore(name, fingerprint string, backend krakendrate.TypedBackend[krakendrate.Limiter], builder func() krakendrate.Limiter, shards uint64) *store {
+	s := &store{
+		name:        name,
+		fingerprint: fingerprint,
+		backend:     backend,
+		builder:     builder,
+		pending:     make([]*pendingShard, shards),
+	}
+	for i := range s.pending {
+		s.pending[i] = &pendingShard{deltas: map[string]uint64{}, mu: new(sync.Mutex)}
+	}
+	return s
+}
+
+func (s *store) load(key string) krakendrate.Limiter {
+	return s.backend.Load(key, s.builder)
+}
+
+// shard returns the partition of the key, using the same hash as the sharded backends
+func (s *store) shard(key string) *pendingShard {
+	return s.pending[krakendrate.PseudoFNV64a(key)%uint64(len(s.pending))]
+}
+
+func (s *store) record(key string, n uint64) {
+	s.shard(key).add(key, n)
+}
+
+func (s *store) unrecord(key string, n uint64) {
+	s.shard(key).sub(key, n)
+}
+
+// apply charges the usage of a peer to the local limiter of the key
+func (s *store) apply(key string, n uint64) {
+	if c, ok := s.load(key).(krakendrate.ChargeableLimiter); ok {
+		c.Charge(n)
+	}
+}
+
+// pendingShard accumulates the local usage of the keys of a shard until the next flush
+type pendingShard struct {
+	deltas map[string]uint64
+	mu     *sync.Mutex
+}
+
+func (p *pendingShard) add(key string, n uint64) {
+	p.mu.Lock()
+	p.deltas[key] += n
+	p.mu.Unlock()
+}
+
+// sub removes up to n units of the pending usage of the key
+func (p *pendingShard) sub(key string, n uint64) {
+	p.mu.Lock()
+	if d, ok := p.deltas[key]; ok {
+		if d <= n {
+			delete(p.deltas, key)
+		} else {
+			p.deltas[key] = d - n
+		}
+	}
+	p.mu.Unlock()
+}
+
+func (p *pendingShard) swap() map[string]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.deltas) == 0 {
+		return nil
+	}
+	deltas := p.deltas
+	p.deltas = map[string]uint64{}
+	return deltas
+}
@@ -0,0 +1,244 @@
+package gossip
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+func TestNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes := make([]*Node, 3)
+	stores := make([]krakendrate.LimiterStore, 3)
+	for i := range nodes {
+		n, err := New(ctx, Config{Bind: "127.0.0.1:0", Interval: 10 * time.Millisecond, Shards: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Close()
+		nodes[i] = n
+		backend := krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute)
+		stores[i], err = n.Store("endpoint", "10", backend, func() krakendrate.Limiter {
+			return krakendrate.NewTokenBucket(0.001, 10)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, n := range nodes {
+		var peers []string
+		for j, p := range nodes {
+			if i != j {
+				peers = append(peers, p.Addr().String())
+			}
+		}
+		if err := n.SetPeers(peers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		if !stores[0]("a").Allow() {
+			t.Errorf("request #%d to the first node should be allowed", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if !stores[1]("a").Allow() {
+			t.Errorf("request #%d to the second node should be allowed", i)
+		}
+	}
+	if !stores[1]("b").Allow() {
+		t.Error("every key should have its own limiter")
+	}
+
+	// every node converges to the usage of the whole cluster
+	for i := range stores {
+		waitForRemaining(t, stores[i]("a"), 2)
+	}
+	waitForRemaining(t, stores[2]("b"), 9)
+
+	for i := 0; i < 2; i++ {
+		if !stores[2]("a").Allow() {
+			t.Errorf("request #%d to the third node should be allowed", i)
+		}
+	}
+	if stores[2]("a").Allow() {
+		t.Error("the cluster-wide limit should be exhausted")
+	}
+}
+
+func TestNode_ignoresUnknownStores(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := New(ctx, Config{Bind: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := New(ctx, Config{Bind: "127.0.0.1:0", Peers: []string{a.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPeers([]string{b.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute)
+	builder := func() krakendrate.Limiter { return krakendrate.NewTokenBucket(0.001, 10) }
+	storeA, _ := a.Store("endpoint-a", "10", backend, builder)
+	storeB, _ := b.Store("endpoint-b", "10", krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute), builder)
+	storeB("a").Allow()
+
+	// closing the node flushes its pending deltas
+	if err := b.Close(); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st := storeA("a").(krakendrate.StatefulLimiter).State(); st.Remaining != 10 {
+		t.Errorf("the deltas of other stores should be ignored. remaining: %d", st.Remaining)
+	}
+}
+
+func TestNode_dropsUntrustedPackets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := New(ctx, Config{Bind: "127.0.0.1:0", Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// b is a peer of a, but it does not know the secret
+	b, err := New(ctx, Config{Bind: "127.0.0.1:0", Peers: []string{a.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// c knows the secret, but it is not a peer of a
+	c, err := New(ctx, Config{Bind: "127.0.0.1:0", Peers: []string{a.Addr().String()}, Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := a.SetPeers([]string{b.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := func() krakendrate.Limiter { return krakendrate.NewTokenBucket(0.001, 10) }
+	storeA, _ := a.Store("endpoint", "10", krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute), builder)
+	for _, n := range []*Node{b, c} {
+		s, _ := n.Store("endpoint", "10", krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute), builder)
+		s("a").Allow()
+		n.Flush()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if st := storeA("a").(krakendrate.StatefulLimiter).State(); st.Remaining != 10 {
+		t.Errorf("the untrusted packets should be dropped. remaining: %d", st.Remaining)
+	}
+}
+
+func TestNode_dropsReplayedPackets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	n, err := New(ctx, Config{Bind: "127.0.0.1:0", Peers: []string{peer.LocalAddr().String()}, Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	builder := func() krakendrate.Limiter { return krakendrate.NewTokenBucket(0.001, 10) }
+	s, _ := n.Store("endpoint", "10", krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute), builder)
+
+	seq := newSequence(uint64(time.Now().UnixNano()))
+	first := encode("endpoint", 0, map[string]uint64{"a": 1}, seq, []byte("s3cr3t"))[0]
+	second := encode("endpoint", 0, map[string]uint64{"a": 2}, seq, []byte("s3cr3t"))[0]
+	// the second packet arrives before the first one, and both of them are replayed
+	for _, p := range [][]byte{second, first, second, first} {
+		if _, err := peer.WriteToUDP(p, n.Addr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForRemaining(t, s("a"), 7)
+	time.Sleep(50 * time.Millisecond)
+	if st := s("a").(krakendrate.StatefulLimiter).State(); st.Remaining != 7 {
+		t.Errorf("the replayed packets should be dropped. remaining: %d", st.Remaining)
+	}
+}
+
+func TestNode_Store_conflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n, err := New(ctx, Config{Bind: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	backend := krakendrate.NewTypedMemoryBackend[krakendrate.Limiter](ctx, time.Minute)
+	builder := func() krakendrate.Limiter { return krakendrate.NewTokenBucket(0.001, 10) }
+	if _, err := n.Store("endpoint", "10", backend, builder); err != nil {
+		t.Error(err)
+	}
+	if _, err := n.Store("endpoint", "10", backend, builder); err != nil {
+		t.Errorf("the same limits should reuse the store: %v", err)
+	}
+	if _, err := n.Store("endpoint", "20", backend, builder); err != ErrStoreConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNew_noBindAddress(t *testing.T) {
+	if _, err := New(context.Background(), Config{}); err != ErrNoBindAddress {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := new(replayWindow)
+	for i, tc := range []struct {
+		seq  uint64
+		want bool
+	}{
+		{seq: 100, want: true},
+		{seq: 100, want: false},
+		{seq: 102, want: true},
+		{seq: 101, want: true},
+		{seq: 101, want: false},
+		{seq: 102 + replayWindowSize, want: true},
+		{seq: 102, want: false},
+		{seq: 103, want: true},
+		{seq: 103, want: false},
+	} {
+		if got := w.accept(tc.seq); got != tc.want {
+			t.Errorf("#%d (%d): want %v, have %v", i, tc.seq, tc.want, got)
+		}
+	}
+}
+
+func waitForRemaining(t *testing.T, l krakendrate.Limiter, want uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	var st krakendrate.LimiterState
+	for time.Now().Before(deadline) {
+		if st = l.(krakendrate.StatefulLimiter).State(); st.Remaining == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("unexpected remaining tokens. have: %d, want: %d", st.Remaining, want)
+}
@@ -11,6 +11,10 @@ var (
 	// ErrLimited is the error returned when the rate limit has been exceded
 	ErrLimited = errors.New("rate limit exceded")
 
+	// ErrWaitDeadline is the error returned when the context deadline expires before
+	// the rate limit allows the request
+	ErrWaitDeadline = errors.New("rate limit wait exceeds the context deadline")
+
 	// DataTTL is the default eviction time
 	DataTTL = 10 * time.Minute
 
@@ -25,13 +29,60 @@ type Limiter interface {
 	Allow() bool
 }
 
+// LimiterState describes the state of a limiter at a given instant
+type LimiterState struct {
+	// Limit is the maximum number of requests the limiter can accept at once
+	Limit uint64
+	// Remaining is the number of requests the limiter would accept right now
+	Remaining uint64
+	// RetryAfter is the time until the limiter accepts a new request. It is zero when
+	// there are remaining requests
+	RetryAfter time.Duration
+	// Reset is the time until the limiter is back to its full capacity
+	Reset time.Duration
+}
+
+// StatefulLimiter extends the Limiter interface with a method for inspecting its state
+// without consuming any token
+type StatefulLimiter interface {
+	Limiter
+	State() LimiterState
+}
+
+// RefundableLimiter extends the Limiter interface with a method for giving back
+// tokens previously taken
+type RefundableLimiter interface {
+	Limiter
+	Refund(uint64)
+}
+
+// ChargeableLimiter extends the Limiter interface with a method for taking tokens after the
+// fact, once the real cost of a request is known. The limiter can go into debt, rejecting the
+// next requests until the debt is repaid
+type ChargeableLimiter interface {
+	Limiter
+	Charge(uint64)
+}
+
+// WaitLimiter extends the Limiter interface with methods for consuming several
+// tokens at once and for waiting until they are available
+type WaitLimiter interface {
+	Limiter
+	AllowN(uint64) bool
+	Wait(context.Context, uint64) error
+}
+
 // LimiterStore defines the interface for a limiter lookup function
 type LimiterStore func(string) Limiter
 
 // Backend is the interface of the persistence layer
-type Backend interface {
-	Load(string, func() interface{}) interface{}
-	Store(string, interface{}) error
+type Backend = TypedBackend[interface{}]
+
+// TypedBackend is the interface of a persistence layer storing values of type T, so they can be
+// loaded without type assertions
+type TypedBackend[T any] interface {
+	Load(string, func() T) T
+	Store(string, T) error
 }
 
 // DefaultShardedMemoryBackend is a 2048 sharded ShardedMemoryBackend
@@ -26,6 +26,30 @@ func TestMemoryBackend(t *testing.T) {
 	}
 }
 
+func TestTypedMemoryBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mb TypedBackend[int] = NewTypedMemoryBackend[int](ctx, time.Minute)
+	builds := 0
+	builder := func() int {
+		builds++
+		return 42
+	}
+	if v := mb.Load("a", builder); v != 42 {
+		t.Errorf("unexpected value: %d", v)
+	}
+	if v := mb.Load("a", builder); v != 42 || builds != 1 {
+		t.Errorf("the value should be built once. value: %d, builds: %d", v, builds)
+	}
+	if err := mb.Store("a", 7); err != nil {
+		t.Error(err)
+	}
+	if v := mb.Load("a", builder); v != 7 {
+		t.Errorf("unexpected value after the store: %d", v)
+	}
+}
+
 func testBackend(t *testing.T, _ int, f func(context.Context, time.Duration) Backend) {
 	ttl := time.Second
 	ctx, cancel := context.WithCancel(context.Background())
@@ -0,0 +1,122 @@
+package krakendrate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewLeakyBucket returns a leaky bucket shaper releasing requests at the given rate and
+// queueing up to maxQueue of them, using the default clock
+func NewLeakyBucket(rate float64, maxQueue uint64) *LeakyBucket {
+	return NewLeakyBucketWithClock(rate, maxQueue, nil)
+}
+
+// NewLeakyBucketWithClock returns a leaky bucket shaper releasing requests at the given rate
+// and queueing up to maxQueue of them, using the received clock
+func NewLeakyBucketWithClock(rate float64, maxQueue uint64, c Clock) *LeakyBucket {
+	if c == nil {
+		c = defaultClock{}
+	}
+	if rate < 1e-9 {
+		rate = 1e-9
+	}
+	return &LeakyBucket{
+		interval: time.Duration(int64(1e9 / rate)),
+		maxQueue: maxQueue,
+		clock:    c,
+		mu:       new(sync.Mutex),
+	}
+}
+
+// LeakyBucket is an implementation of the leaky bucket pattern as a queue: instead of
+// rejecting the requests exceeding the rate, it delays them so they are released at a
+// constant pace. Requests are only rejected when the queue is full.
+type LeakyBucket struct {
+	interval time.Duration
+	maxQueue uint64
+	clock    Clock
+	next     time.Time
+	mu       *sync.Mutex
+}
+
+// Allow flags if the current request can be processed right now, without waiting in the queue.
+// It updates the internal state if the request can be processed
+func (l *LeakyBucket) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.clock.Now()
+	if l.next.After(n) {
+		return false
+	}
+	l.next = n.Add(l.interval)
+	return true
+}
+
+// Wait blocks until the request is released by the bucket. It returns ErrLimited without
+// waiting if the queue is full or if the request would be released after the deadline
+// of the context, and the error of the context if it is done while waiting.
+func (l *LeakyBucket) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	n := l.clock.Now()
+	slot := l.next
+	if slot.Before(n) {
+		slot = n
+	}
+	delay := slot.Sub(n)
+	// number of requests waiting in the queue, including this one
+	if uint64((delay+l.interval-1)/l.interval) > l.maxQueue {
+		l.mu.Unlock()
+		return ErrLimited
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(n.Add(delay)) {
+		l.mu.Unlock()
+		return ErrLimited
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		// give the slot back if no other request has been queued after this one
+		if l.next.Equal(slot.Add(l.interval)) {
+			l.next = slot
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// State returns the current state of the bucket. The limit is the number of requests that
+// can be accepted at once: the one released right away plus the ones waiting in the queue.
+func (l *LeakyBucket) State() LimiterState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := LimiterState{
+		Limit:     l.maxQueue + 1,
+		Remaining: l.maxQueue + 1,
+	}
+	delay := l.next.Sub(l.clock.Now())
+	if delay <= 0 {
+		return st
+	}
+	st.Reset = delay
+	if queued := uint64((delay + l.interval - 1) / l.interval); queued < st.Limit {
+		st.Remaining -= queued
+	} else {
+		st.Remaining = 0
+		st.RetryAfter = delay - time.Duration(l.maxQueue)*l.interval
+	}
+	return st
+}
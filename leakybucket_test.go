@@ -0,0 +1,105 @@
+package krakendrate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucket_Allow(t *testing.T) {
+	clk := newTestClock()
+	lb := NewLeakyBucketWithClock(10, 5, clk)
+
+	if !lb.Allow() {
+		t.Error("the first request should be allowed")
+	}
+	if lb.Allow() {
+		t.Error("the second request should not be allowed without waiting")
+	}
+	clk.Add(100 * time.Millisecond)
+	if !lb.Allow() {
+		t.Error("the request should be allowed after the interval")
+	}
+}
+
+func TestLeakyBucket_Wait(t *testing.T) {
+	lb := NewLeakyBucket(20, 4)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			errs <- lb.Wait(context.Background())
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var ok, ko int
+	for err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case ErrLimited:
+			ko++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	// the first request is released immediately and 4 more are queued
+	if ok != 5 || ko != 5 {
+		t.Errorf("unexpected results. ok: %d, ko: %d", ok, ko)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the queued requests were released too soon: %s", elapsed)
+	}
+}
+
+func TestLeakyBucket_WaitDeadline(t *testing.T) {
+	lb := NewLeakyBucket(1, 10)
+
+	if err := lb.Wait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := lb.Wait(ctx); err != ErrLimited {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("the request should be rejected without waiting: %s", elapsed)
+	}
+}
+
+func TestLeakyBucket_State(t *testing.T) {
+	clk := newTestClock()
+	lb := NewLeakyBucketWithClock(1000, 2, clk)
+
+	if st := lb.State(); st != (LimiterState{Limit: 3, Remaining: 3}) {
+		t.Errorf("unexpected state of an unused bucket: %+v", st)
+	}
+
+	lb.Allow()
+	for i := 0; i < 2; i++ {
+		if err := lb.Wait(context.Background()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	want := LimiterState{Limit: 3, RetryAfter: time.Millisecond, Reset: 3 * time.Millisecond}
+	if st := lb.State(); st != want {
+		t.Errorf("unexpected state of a full queue: %+v", st)
+	}
+
+	clk.Add(1500 * time.Microsecond)
+	want = LimiterState{Limit: 3, Remaining: 1, Reset: 1500 * time.Microsecond}
+	if st := lb.State(); st != want {
+		t.Errorf("unexpected state: %+v", st)
+	}
+}
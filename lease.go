@@ -0,0 +1,201 @@
+package krakendrate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenLeaser is the interface of the shared stores able to grant batches of tokens, so the
+// limiters can consume them locally instead of calling the store on every request
+type TokenLeaser interface {
+	// Lease takes up to n tokens from the bucket of the key and returns the amount granted
+	Lease(ctx context.Context, key string, n uint64) (uint64, error)
+	// Release gives n unused tokens back to the bucket of the key
+	Release(ctx context.Context, key string, n uint64) error
+}
+
+// LeaseOptions define the behaviour of the leased limiters
+type LeaseOptions struct {
+	// Size is the amount of tokens requested on every lease. Bigger leases require fewer calls
+	// to the shared store, but the tokens leased by an instance can not be used by the rest of
+	// them until they are released
+	Size uint64
+	// TTL is the duration of a lease. The tokens still unused when it expires are released
+	TTL time.Duration
+	// Timeout is the maximum duration of every call to the shared store. Zero means no timeout
+	Timeout time.Duration
+	// FailOpen allows the requests when the shared store fails. Otherwise, they are rejected
+	FailOpen bool
+}
+
+// NewLeasedLimiterStore returns a LimiterStore whose limiters serve the requests with the tokens
+// leased from the shared store, persisting them in the received backend. A nil clock means the
+// default one.
+func NewLeasedLimiterStore(leaser TokenLeaser, backend TypedBackend[Limiter], opts LeaseOptions, clk Clock) LimiterStore {
+	return func(key string) Limiter {
+		return backend.Load(key, func() Limiter {
+			return NewLeasedLimiter(leaser, key, opts, clk)
+		})
+	}
+}
+
+// NewLeasedLimiter returns a limiter serving the requests of the key with the tokens leased from
+// the shared store. A nil clock means the default one.
+func NewLeasedLimiter(leaser TokenLeaser, key string, opts LeaseOptions, clk Clock) *LeasedLimiter {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Second
+	}
+	return &LeasedLimiter{
+		leaser: leaser,
+		key:    key,
+		opts:   opts,
+		// the local bucket does not generate tokens: it only holds the leased ones
+		local: NewTokenBucketWithInitialStock(minTokenBucketRate, opts.Size, 0, clk),
+		clock: clk,
+		mu:    new(sync.Mutex),
+	}
+}
+
+// LeasedLimiter is a hybrid limiter taking batches of tokens from a shared store into a local
+// token bucket, so most of the requests are served without calling the store. The unused tokens
+// are released by a timer once the lease expires, or by the next request if the expiration, checked
+// with the clock of the limiter, comes first. After an empty or failed lease, the limiter does not
+// call the store again until that lease expires: it rejects the requests, or applies the FailOpen
+// option after a failure.
+//
+// The calls to the store are made while holding the lock of the limiter, so the concurrent
+// requests of the same key wait for the lease in progress instead of leasing more tokens.
+type LeasedLimiter struct {
+	leaser  TokenLeaser
+	key     string
+	opts    LeaseOptions
+	local   *TokenBucket
+	expires time.Time
+	// exhausted flags if the current lease is empty
+	exhausted bool
+	// failed flags if the current lease could not be taken from the store
+	failed bool
+	// lease identifies the current lease, so an outdated timer does not release the tokens of
+	// the next one
+	lease uint64
+	timer *time.Timer
+	clock Clock
+	mu    *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It leases a new batch of tokens
+// when the local ones are exhausted or expired
+func (l *LeasedLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	expired := !now.Before(l.expires)
+	if !expired {
+		if l.local.Allow() {
+			return true
+		}
+		if l.failed {
+			return l.opts.FailOpen
+		}
+		if l.exhausted {
+			return false
+		}
+	}
+
+	ctx, cancel := l.context()
+	defer cancel()
+
+	if expired {
+		if unused := l.takeUnused(); unused > 0 {
+			// the release is best effort: the tokens not released are lost until the shared
+			// bucket refills
+			_ = l.leaser.Release(ctx, l.key, unused)
+		}
+	}
+
+	granted, err := l.leaser.Lease(ctx, l.key, l.opts.Size)
+	l.expires = now.Add(l.opts.TTL)
+	l.exhausted = err == nil && granted == 0
+	l.failed = err != nil
+	l.lease++
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if err != nil {
+		return l.opts.FailOpen
+	}
+	if granted == 0 {
+		return false
+	}
+	l.local.Refund(granted)
+	lease := l.lease
+	l.timer = time.AfterFunc(l.opts.TTL, func() { l.expire(lease) })
+	return l.local.Allow()
+}
+
+// Release gives the unused tokens of the current lease back to the shared store
+func (l *LeasedLimiter) Release(ctx context.Context) error {
+	l.mu.Lock()
+	unused := l.endLease()
+	l.mu.Unlock()
+
+	if unused == 0 {
+		return nil
+	}
+	return l.leaser.Release(ctx, l.key, unused)
+}
+
+// expire releases the unused tokens of the lease, unless it has already been replaced
+func (l *LeasedLimiter) expire(lease uint64) {
+	l.mu.Lock()
+	if lease != l.lease {
+		l.mu.Unlock()
+		return
+	}
+	unused := l.endLease()
+	l.mu.Unlock()
+
+	if unused > 0 {
+		ctx, cancel := l.context()
+		defer cancel()
+		_ = l.leaser.Release(ctx, l.key, unused)
+	}
+}
+
+// endLease finishes the current lease, returning its unused tokens
+func (l *LeasedLimiter) endLease() uint64 {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.lease++
+	l.expires = time.Time{}
+	l.exhausted = false
+	l.failed = false
+	return l.takeUnused()
+}
+
+// takeUnused removes the unused tokens from the local bucket and returns them
+func (l *LeasedLimiter) takeUnused() uint64 {
+	unused := l.local.State().Remaining
+	if unused > 0 {
+		l.local.Charge(unused)
+	}
+	return unused
+}
+
+func (l *LeasedLimiter) context() (context.Context, context.CancelFunc) {
+	if l.opts.Timeout > 0 {
+		return context.WithTimeout(context.Background(), l.opts.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
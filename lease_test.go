@@ -0,0 +1,198 @@
+package krakendrate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeasedLimiter(t *testing.T) {
+	clk := newTestClock()
+	leaser := &fakeLeaser{available: 12}
+	l := NewLeasedLimiter(leaser, "a", LeaseOptions{Size: 5, TTL: time.Second}, clk)
+
+	for i := 0; i < 12; i++ {
+		if !l.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if l.Allow() {
+		t.Error("the shared bucket should be exhausted")
+	}
+	// 3 leases: 5 + 5 + 2 tokens, plus the failed one
+	if leaser.leases != 4 {
+		t.Errorf("unexpected number of leases: %d", leaser.leases)
+	}
+}
+
+func TestLeasedLimiter_releaseOnExpiration(t *testing.T) {
+	clk := newTestClock()
+	leaser := &fakeLeaser{available: 100}
+	l := NewLeasedLimiter(leaser, "a", LeaseOptions{Size: 10, TTL: time.Second}, clk)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if leaser.available != 90 {
+		t.Errorf("unexpected shared tokens: %d", leaser.available)
+	}
+
+	clk.Add(time.Second)
+	if !l.Allow() {
+		t.Error("the request should be allowed with a new lease")
+	}
+	// the 7 unused tokens were released before leasing 10 more
+	if leaser.available != 87 || leaser.released != 7 {
+		t.Errorf("unexpected shared tokens: %d (released %d)", leaser.available, leaser.released)
+	}
+
+	if err := l.Release(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if leaser.available != 96 {
+		t.Errorf("unexpected shared tokens after the release: %d", leaser.available)
+	}
+}
+
+func TestLeasedLimiter_releaseByTimer(t *testing.T) {
+	leaser := &fakeLeaser{available: 100}
+	l := NewLeasedLimiter(leaser, "a", LeaseOptions{Size: 10, TTL: 10 * time.Millisecond}, nil)
+
+	if !l.Allow() {
+		t.Error("the request should be allowed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if available, released := leaser.state(); available == 99 && released == 9 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	available, released := leaser.state()
+	t.Errorf("the unused tokens were not released on expiration: %d (released %d)", available, released)
+}
+
+func TestLeasedLimiter_backOffAfterEmptyLease(t *testing.T) {
+	clk := newTestClock()
+	leaser := &fakeLeaser{}
+	l := NewLeasedLimiter(leaser, "a", LeaseOptions{Size: 10, TTL: time.Second}, clk)
+
+	for i := 0; i < 5; i++ {
+		if l.Allow() {
+			t.Errorf("request #%d should be rejected", i)
+		}
+	}
+	if leaser.leases != 1 {
+		t.Errorf("no lease should be requested until the empty one expires. leases: %d", leaser.leases)
+	}
+
+	leaser.mu.Lock()
+	leaser.available = 10
+	leaser.mu.Unlock()
+	clk.Add(time.Second)
+	if !l.Allow() {
+		t.Error("the request should be allowed with a new lease")
+	}
+	if leaser.leases != 2 {
+		t.Errorf("unexpected number of leases: %d", leaser.leases)
+	}
+}
+
+func TestLeasedLimiter_failOpen(t *testing.T) {
+	leaser := &fakeLeaser{err: errors.New("unreachable")}
+	if NewLeasedLimiter(leaser, "a", LeaseOptions{}, nil).Allow() {
+		t.Error("the request should be rejected when failing closed")
+	}
+	if !NewLeasedLimiter(leaser, "a", LeaseOptions{FailOpen: true}, nil).Allow() {
+		t.Error("the request should be allowed when failing open")
+	}
+}
+
+func TestLeasedLimiter_backOffAfterError(t *testing.T) {
+	clk := newTestClock()
+	leaser := &fakeLeaser{err: errors.New("unreachable")}
+	l := NewLeasedLimiter(leaser, "a", LeaseOptions{Size: 10, TTL: time.Second, FailOpen: true}, clk)
+
+	for i := 0; i < 5; i++ {
+		if !l.Allow() {
+			t.Errorf("request #%d should be allowed when failing open", i)
+		}
+	}
+	if leaser.leases != 1 {
+		t.Errorf("no lease should be requested until the failed one expires. leases: %d", leaser.leases)
+	}
+
+	leaser.mu.Lock()
+	leaser.err = nil
+	leaser.available = 1
+	leaser.mu.Unlock()
+	clk.Add(time.Second)
+	if !l.Allow() {
+		t.Error("the request should be allowed with a new lease")
+	}
+	if l.Allow() {
+		t.Error("the request should be rejected once the store recovers")
+	}
+	if leaser.leases != 3 {
+		t.Errorf("unexpected number of leases: %d", leaser.leases)
+	}
+}
+
+func TestNewLeasedLimiterStore(t *testing.T) {
+	leaser := &fakeLeaser{available: 100}
+	backend := NewTypedMemoryBackend[Limiter](context.Background(), time.Minute)
+	store := NewLeasedLimiterStore(leaser, backend, LeaseOptions{Size: 10}, nil)
+
+	for i := 0; i < 10; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if leaser.leases != 1 {
+		t.Errorf("the limiter should be reused. leases: %d", leaser.leases)
+	}
+}
+
+type fakeLeaser struct {
+	mu        sync.Mutex
+	available uint64
+	leases    int
+	released  uint64
+	err       error
+}
+
+func (f *fakeLeaser) Lease(_ context.Context, _ string, n uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leases++
+	if f.err != nil {
+		return 0, f.err
+	}
+	if n > f.available {
+		n = f.available
+	}
+	f.available -= n
+	return n, nil
+}
+
+func (f *fakeLeaser) state() (available, released uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.available, f.released
+}
+
+func (f *fakeLeaser) Release(_ context.Context, _ string, n uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.available += n
+	f.released += n
+	return nil
+}
@@ -0,0 +1,252 @@
+// Package memcached contains limiter stores keeping their state in a memcached server, so all the
+// instances of a cluster share the same limits
+package memcached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+// maxCASAttempts is the number of times a GCRA limiter retries its update when other instances
+// modify the same key concurrently
+const maxCASAttempts = 10
+
+// MaxExpiration is the longest expiration of the memcached items, since the longer ones are taken
+// as unix timestamps. The stores must not keep their state longer than it
+const MaxExpiration = 30 * 24 * time.Hour
+
+// ErrTooManyConflicts is the error returned when a limiter can not update its state because of the
+// concurrent updates of other instances
+var ErrTooManyConflicts = errors.New("too many concurrent updates")
+
+// Client is the subset of the memcached client used by the limiters. It is satisfied by
+// *memcache.Client
+type Client interface {
+	Get(key string) (*memcache.Item, error)
+	Add(item *memcache.Item) error
+	Increment(key string, delta uint64) (uint64, error)
+	CompareAndSwap(item *memcache.Item) error
+}
+
+// Options define the behaviour of the limiters of a memcached store
+type Options struct {
+	// KeyPrefix is prepended to the keys of the limiters. The client keys are hashed, so only the
+	// prefix counts towards the 250 bytes limit of the memcached keys
+	KeyPrefix string
+	// FailOpen allows the requests when memcached can not be reached. Otherwise, they are rejected
+	FailOpen bool
+	// Clock is the source of time of the limiters. A nil clock means the system one. Since memcached
+	// does not expose its clock, all the instances sharing a server should keep their clocks in sync.
+	Clock krakendrate.Clock
+}
+
+// NewFixedWindowStore returns a LimiterStore whose limiters accept up to limit requests per window,
+// counting them in memcached with add and incr. The windows are aligned to multiples of the window
+// duration since the zero time, like the ones of krakendrate.FixedWindow. Windows longer than
+// MaxExpiration are shortened to it
+func NewFixedWindowStore(client Client, limit uint64, window time.Duration, opts Options) krakendrate.LimiterStore {
+	if limit < 1 {
+		limit = 1
+	}
+	if window < time.Second {
+		// memcached expirations have a resolution of seconds
+		window = time.Second
+	}
+	if window > MaxExpiration {
+		window = MaxExpiration
+	}
+	clk := opts.Clock
+	if clk == nil {
+		clk = krakendrate.SystemClock
+	}
+
+	return func(key string) krakendrate.Limiter {
+		return &FixedWindow{
+			client: client,
+			key:    limiterKey(opts.KeyPrefix, key),
+			limit:  limit,
+			window: window,
+			opts:   opts,
+			clock:  clk,
+		}
+	}
+}
+
+// FixedWindow is a fixed window limiter whose counters are kept in memcached
+type FixedWindow struct {
+	client Client
+	key    string
+	limit  uint64
+	window time.Duration
+	opts   Options
+	clock  krakendrate.Clock
+}
+
+// Allow flags if the current request can be processed or not. When memcached fails, the request is
+// allowed if the store is configured to fail open
+func (f *FixedWindow) Allow() bool {
+	ok, err := f.AllowWithError()
+	if err != nil {
+		return f.opts.FailOpen
+	}
+	return ok
+}
+
+// AllowWithError flags if the current request can be processed or not, reporting the errors of
+// memcached
+func (f *FixedWindow) AllowWithError() (bool, error) {
+	n := f.clock.Now()
+	start := n.Truncate(f.window)
+	key := f.key + ":" + strconv.FormatInt(start.Unix(), 10)
+
+	count, err := f.client.Increment(key, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		// the counter of the window does not exist yet, so it expires once the window is over
+		err = f.client.Add(&memcache.Item{
+			Key:        key,
+			Value:      []byte("1"),
+			Expiration: expiration(start.Add(f.window).Sub(n)),
+		})
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return false, err
+		}
+		// another instance created the counter in the meantime
+		count, err = f.client.Increment(key, 1)
+	}
+	if err != nil {
+		return false, err
+	}
+	return count <= f.limit, nil
+}
+
+// NewGCRAStore returns a LimiterStore whose limiters implement the generic cell rate algorithm with
+// the given rate and burst capacity, keeping the theoretical arrival time in memcached and updating
+// it with add and cas. The items can not outlive MaxExpiration, so the theoretical arrival times
+// further in the future are lost: the rate and capacity must keep (capacity+1)/rate below it
+func NewGCRAStore(client Client, rate float64, capacity uint64, opts Options) krakendrate.LimiterStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if rate < 1e-9 {
+		rate = 1e-9
+	}
+	emissionInterval := time.Duration(int64(1e9 / rate))
+	clk := opts.Clock
+	if clk == nil {
+		clk = krakendrate.SystemClock
+	}
+
+	return func(key string) krakendrate.Limiter {
+		return &GCRA{
+			client:           client,
+			key:              limiterKey(opts.KeyPrefix, key),
+			emissionInterval: emissionInterval,
+			tolerance:        time.Duration(capacity) * emissionInterval,
+			opts:             opts,
+			clock:            clk,
+		}
+	}
+}
+
+// GCRA is a limiter implementing the generic cell rate algorithm whose theoretical arrival time
+// is kept in memcached
+type GCRA struct {
+	client           Client
+	key              string
+	emissionInterval time.Duration
+	tolerance        time.Duration
+	opts             Options
+	clock            krakendrate.Clock
+}
+
+// Allow flags if the current request can be processed or not. When memcached fails, the request is
+// allowed if the store is configured to fail open
+func (g *GCRA) Allow() bool {
+	ok, err := g.AllowWithError()
+	if err != nil {
+		return g.opts.FailOpen
+	}
+	return ok
+}
+
+// AllowWithError flags if the current request can be processed or not, reporting the errors of
+// memcached
+func (g *GCRA) AllowWithError() (bool, error) {
+	for i := 0; i < maxCASAttempts; i++ {
+		n := g.clock.Now()
+		item, err := g.client.Get(g.key)
+		if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return false, err
+		}
+
+		tat := n
+		if item != nil {
+			stored, err := strconv.ParseInt(string(item.Value), 10, 64)
+			if err != nil {
+				return false, fmt.Errorf("wrong state for %q: %w", g.key, err)
+			}
+			if t := time.Unix(0, stored); t.After(n) {
+				tat = t
+			}
+		}
+		newTat := tat.Add(g.emissionInterval)
+		if n.Before(newTat.Add(-g.tolerance)) {
+			return false, nil
+		}
+
+		value := []byte(strconv.FormatInt(newTat.UnixNano(), 10))
+		// the state is useless once the theoretical arrival time is in the past
+		exp := expiration(newTat.Sub(n))
+		if item == nil {
+			err = g.client.Add(&memcache.Item{Key: g.key, Value: value, Expiration: exp})
+		} else {
+			item.Value = value
+			item.Expiration = exp
+			err = g.client.CompareAndSwap(item)
+		}
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, memcache.ErrNotStored), errors.Is(err, memcache.ErrCASConflict),
+			errors.Is(err, memcache.ErrCacheMiss):
+			// another instance updated the key in the meantime, so try again with its state
+			continue
+		default:
+			return false, err
+		}
+	}
+	return false, ErrTooManyConflicts
+}
+
+// limiterKey returns the memcached key of the limiter of a client. The client key is replaced by
+// its hex encoded SHA-1, since memcached rejects the keys longer than 250 bytes or containing
+// spaces or control characters, like the values of some headers
+func limiterKey(prefix, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// expiration returns the memcached expiration for the given duration, rounded up to seconds
+func expiration(d time.Duration) int32 {
+	s := math.Ceil(d.Seconds())
+	if s < 1 {
+		return 1
+	}
+	// longer expirations would be taken as unix timestamps
+	if max := MaxExpiration.Seconds(); s > max {
+		return int32(max)
+	}
+	return int32(s)
+}
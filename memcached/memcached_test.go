@@ -0,0 +1,334 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+func TestNewFixedWindowStore(t *testing.T) {
+	clk := &testClock{now: time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)}
+	c, srv := newTestClient(t)
+	opts := Options{KeyPrefix: "rl:", Clock: clk}
+	store := NewFixedWindowStore(c, 3, time.Minute, opts)
+
+	// two instances sharing the same server share the same counters
+	for i := 0; i < 3; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if NewFixedWindowStore(c, 3, time.Minute, opts)("a").Allow() {
+		t.Error("the window should be exhausted for all the instances")
+	}
+	if !store("b").Allow() {
+		t.Error("every key should have its own counter")
+	}
+
+	key := fmt.Sprintf("%s:%d", limiterKey("rl:", "a"), clk.Now().Truncate(time.Minute).Unix())
+	if exp := srv.expiration(key); exp != 50 {
+		t.Errorf("the counter should expire at the end of the window. got: %d", exp)
+	}
+
+	clk.Add(50 * time.Second)
+	if !store("a").Allow() {
+		t.Error("the next window should start a new counter")
+	}
+}
+
+func TestNewGCRAStore(t *testing.T) {
+	clk := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c, _ := newTestClient(t)
+	opts := Options{Clock: clk}
+	store := NewGCRAStore(c, 10, 5, opts)
+
+	for i := 0; i < 5; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if NewGCRAStore(c, 10, 5, opts)("a").Allow() {
+		t.Error("the burst should be exhausted for all the instances")
+	}
+	if !store("b").Allow() {
+		t.Error("every key should have its own state")
+	}
+
+	clk.Add(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !store("a").Allow() {
+			t.Errorf("refilled request #%d should be allowed", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the limiter should reject the requests after consuming the refill")
+	}
+}
+
+func TestNewGCRAStore_concurrentInstances(t *testing.T) {
+	clk := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c, _ := newTestClient(t)
+
+	var allowed int64
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := NewGCRAStore(c, 1, 20, Options{Clock: clk})("a")
+			for j := 0; j < 10; j++ {
+				if l.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed > 20 {
+		t.Errorf("the instances accepted %d requests, more than the capacity", allowed)
+	}
+}
+
+func TestStores_unsafeKeys(t *testing.T) {
+	c, _ := newTestClient(t)
+	clk := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for _, key := range []string{
+		"Bearer eyJhbGciOiJIUzI1NiJ9.e30.ZRrHA1JJJW8opsbCGfG_HACGpVUMN_a9IV7pAx_Zmeo",
+		strings.Repeat("k", 300),
+		"line\nbreak",
+	} {
+		for name, store := range map[string]krakendrate.LimiterStore{
+			"fixed window": NewFixedWindowStore(c, 1, time.Minute, Options{Clock: clk}),
+			"gcra":         NewGCRAStore(c, 1e-6, 1, Options{Clock: clk}),
+		} {
+			if !store(key).Allow() {
+				t.Errorf("%s: the first request of %q should be allowed", name, key)
+			}
+			if store(key).Allow() {
+				t.Errorf("%s: the second request of %q should be rejected", name, key)
+			}
+		}
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.Close()
+	c.Timeout = 50 * time.Millisecond
+
+	for _, tc := range []struct {
+		name  string
+		store func(Options) bool
+	}{
+		{"fixed window", func(o Options) bool { return NewFixedWindowStore(c, 1, time.Second, o)("a").Allow() }},
+		{"gcra", func(o Options) bool { return NewGCRAStore(c, 1, 1, o)("a").Allow() }},
+	} {
+		if tc.store(Options{}) {
+			t.Errorf("%s: the requests should be rejected when failing closed", tc.name)
+		}
+		if !tc.store(Options{FailOpen: true}) {
+			t.Errorf("%s: the requests should be allowed when failing open", tc.name)
+		}
+	}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestClient(t *testing.T) (*memcache.Client, *fakeServer) {
+	srv := newFakeServer(t)
+	c := memcache.New(srv.Addr())
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+	return c, srv
+}
+
+// fakeServer is an in-process server speaking the subset of the memcached text protocol used by
+// the limiters. It does not expire the items, but it keeps their expiration for the assertions.
+type fakeServer struct {
+	l     net.Listener
+	mu    sync.Mutex
+	items map[string]*fakeItem
+	cas   uint64
+}
+
+type fakeItem struct {
+	value []byte
+	flags uint32
+	exp   int32
+	cas   uint64
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, items: map[string]*fakeItem{}}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeServer) Close() {
+	s.l.Close()
+}
+
+func (s *fakeServer) expiration(key string) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it, ok := s.items[key]; ok {
+		return it.exp
+	}
+	return -1
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "get", "gets":
+			s.get(rw, fields[1:])
+		case "add", "set", "cas":
+			if !s.store(rw, fields) {
+				return
+			}
+		case "incr":
+			s.incr(rw, fields)
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) get(w *bufio.ReadWriter, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		if it, ok := s.items[k]; ok {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", k, it.flags, len(it.value), it.cas, it.value)
+		}
+	}
+	w.WriteString("END\r\n")
+}
+
+// store handles the add, set and cas commands. It returns false if the connection is broken
+func (s *fakeServer) store(rw *bufio.ReadWriter, fields []string) bool {
+	if len(fields) < 5 {
+		rw.WriteString("ERROR\r\n")
+		return true
+	}
+	flags, _ := strconv.ParseUint(fields[2], 10, 32)
+	exp, _ := strconv.ParseInt(fields[3], 10, 32)
+	size, _ := strconv.Atoi(fields[4])
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, exists := s.items[fields[1]]
+	switch fields[0] {
+	case "add":
+		if exists {
+			rw.WriteString("NOT_STORED\r\n")
+			return true
+		}
+	case "cas":
+		if !exists {
+			rw.WriteString("NOT_FOUND\r\n")
+			return true
+		}
+		if len(fields) < 6 || fields[5] != strconv.FormatUint(it.cas, 10) {
+			rw.WriteString("EXISTS\r\n")
+			return true
+		}
+	}
+	s.cas++
+	s.items[fields[1]] = &fakeItem{value: data[:size], flags: uint32(flags), exp: int32(exp), cas: s.cas}
+	rw.WriteString("STORED\r\n")
+	return true
+}
+
+func (s *fakeServer) incr(w *bufio.ReadWriter, fields []string) {
+	if len(fields) < 3 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	delta, _ := strconv.ParseUint(fields[2], 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[fields[1]]
+	if !ok {
+		w.WriteString("NOT_FOUND\r\n")
+		return
+	}
+	v, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		return
+	}
+	v += delta
+	s.cas++
+	it.value = []byte(strconv.FormatUint(v, 10))
+	it.cas = s.cas
+	fmt.Fprintf(w, "%d\r\n", v)
+}
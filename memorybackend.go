@@ -7,20 +7,30 @@ import (
 	"time"
 )
 
+// MemoryBackendBuilder returns amount MemoryBackends, sharing cleanUpThreads goroutines for
+// evicting the entries not accessed during the last ttl
 func MemoryBackendBuilder(ctx context.Context, ttl, cleanupRate time.Duration,
 	cleanUpThreads, amount uint64,
 ) []Backend {
+	return TypedMemoryBackendBuilder[interface{}](ctx, ttl, cleanupRate, cleanUpThreads, amount)
+}
+
+// TypedMemoryBackendBuilder returns amount TypedMemoryBackends, sharing cleanUpThreads goroutines
+// for evicting the entries not accessed during the last ttl
+func TypedMemoryBackendBuilder[T any](ctx context.Context, ttl, cleanupRate time.Duration,
+	cleanUpThreads, amount uint64,
+) []TypedBackend[T] {
 	if amount == 0 {
-		return []Backend{}
+		return []TypedBackend[T]{}
 	}
-	backends := make([]MemoryBackend, amount)
+	backends := make([]TypedMemoryBackend[T], amount)
 	for idx := range backends {
-		backends[idx].data = map[string]interface{}{}
+		backends[idx].data = map[string]T{}
 		backends[idx].lastAccess = map[string]time.Time{}
 		backends[idx].mu = new(sync.RWMutex)
 	}
 
-	rv := make([]Backend, amount)
+	rv := make([]TypedBackend[T], amount)
 	for idx := range backends {
 		rv[idx] = &(backends[idx])
 	}
@@ -46,9 +56,15 @@ func MemoryBackendBuilder(ctx context.Context, ttl, cleanupRate time.Duration,
 }
 
 func NewMemoryBackend(ctx context.Context, ttl time.Duration) *MemoryBackend {
-	backends := []MemoryBackend{
+	return NewTypedMemoryBackend[interface{}](ctx, ttl)
+}
+
+// NewTypedMemoryBackend returns a TypedMemoryBackend evicting the entries not accessed during
+// the last ttl
+func NewTypedMemoryBackend[T any](ctx context.Context, ttl time.Duration) *TypedMemoryBackend[T] {
+	backends := []TypedMemoryBackend[T]{
 		{
-			data:       map[string]interface{}{},
+			data:       map[string]T{},
 			lastAccess: map[string]time.Time{},
 			mu:         new(sync.RWMutex),
 		},
@@ -60,13 +76,16 @@ func NewMemoryBackend(ctx context.Context, ttl time.Duration) *MemoryBackend {
 }
 
 // MemoryBackend implements the backend interface by wrapping a sync.Map
-type MemoryBackend struct {
-	data       map[string]interface{}
+type MemoryBackend = TypedMemoryBackend[interface{}]
+
+// TypedMemoryBackend implements the TypedBackend interface by wrapping a map of values of type T
+type TypedMemoryBackend[T any] struct {
+	data       map[string]T
 	lastAccess map[string]time.Time
 	mu         *sync.RWMutex
 }
 
-func manageEvictions(ctx context.Context, ttl, cleanupRate time.Duration, backends []MemoryBackend) {
+func manageEvictions[T any](ctx context.Context, ttl, cleanupRate time.Duration, backends []TypedMemoryBackend[T]) {
 	t := time.NewTicker(cleanupRate)
 	for {
 		select {
@@ -91,10 +110,10 @@ func manageEvictions(ctx context.Context, ttl, cleanupRate time.Duration, backen
 	}
 }
 
-// Load implements the Backend interface.
+// Load implements the TypedBackend interface.
 // The f function should always return a non nil value, or that nil value
 // will be assigned and returned on load.
-func (m *MemoryBackend) Load(key string, f func() interface{}) interface{} {
+func (m *TypedMemoryBackend[T]) Load(key string, f func() T) T {
 	var lastAccess time.Time
 	lastAccessOk := true
 
@@ -130,11 +149,74 @@ func (m *MemoryBackend) Load(key string, f func() interface{}) interface{} {
 	return newData
 }
 
-// Store implements the Backend interface
-func (m *MemoryBackend) Store(key string, v interface{}) error {
+// Store implements the TypedBackend interface
+func (m *TypedMemoryBackend[T]) Store(key string, v T) error {
 	m.mu.Lock()
 	m.lastAccess[key] = now()
 	m.data[key] = v
 	m.mu.Unlock()
 	return nil
 }
+
+// LoadContext implements the TypedContextBackend interface
+func (m *TypedMemoryBackend[T]) LoadContext(ctx context.Context, key string, f func() T) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	return m.Load(key, f), nil
+}
+
+// StoreContext implements the TypedContextBackend interface
+func (m *TypedMemoryBackend[T]) StoreContext(ctx context.Context, key string, v T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Store(key, v)
+}
+
+// Delete implements the TypedContextBackend interface
+func (m *TypedMemoryBackend[T]) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.data, key)
+	delete(m.lastAccess, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Range implements the TypedContextBackend interface. It iterates over a snapshot of the data, so
+// f can call any other method of the backend
+func (m *TypedMemoryBackend[T]) Range(ctx context.Context, f func(key string, v T) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.data))
+	values := make([]T, 0, len(m.data))
+	for k, v := range m.data {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	m.mu.RUnlock()
+
+	for i, k := range keys {
+		if !f(k, values[i]) {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// Len implements the TypedContextBackend interface
+func (m *TypedMemoryBackend[T]) Len(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	l := len(m.data)
+	m.mu.RUnlock()
+	return l, nil
+}
@@ -37,6 +37,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/luraproject/lura/v2/config"
@@ -51,8 +52,13 @@ const Namespace = "qos/ratelimit/proxy"
 
 // Config is the custom config struct containing the params for the limiter
 type Config struct {
-	MaxRate  float64 `json:"max_rate"`
-	Capacity uint64  `json:"capacity"`
+	MaxRate  float64       `json:"max_rate"`
+	Capacity uint64        `json:"capacity"`
+	MaxQueue uint64        `json:"max_queue"`
+	Wait     bool          `json:"wait"`
+	Shards   uint64        `json:"shards"`
+	WarmUp   time.Duration `json:"warm_up"`
+	ColdRate float64       `json:"cold_rate"`
 }
 
 // BackendFactory adds a ratelimiting middleware wrapping the internal factory
@@ -76,6 +82,11 @@ func NewMiddleware(logger logging.Logger, remote *config.Backend) proxy.Middlewa
 		return proxy.EmptyMiddleware
 	}
 
+	if cfg.MaxQueue > 0 {
+		logger.Debug(logPrefix, "Enabling the rate shaper")
+		return NewShaperMiddleware(krakendrate.NewLeakyBucket(cfg.MaxRate, cfg.MaxQueue))
+	}
+
 	if cfg.Capacity == 0 {
 		if cfg.MaxRate < 1 {
 			cfg.Capacity = 1
@@ -84,14 +95,31 @@ func NewMiddleware(logger logging.Logger, remote *config.Backend) proxy.Middlewa
 		}
 	}
 
-	tb := krakendrate.NewTokenBucket(cfg.MaxRate, cfg.Capacity)
+	if cfg.WarmUp > 0 {
+		logger.Debug(logPrefix, "Enabling the rate limiter with warm-up")
+		tb := krakendrate.NewWarmUpTokenBucket(cfg.MaxRate, cfg.ColdRate, cfg.Capacity, cfg.WarmUp)
+		return NewReservationMiddleware(tb, cfg.Wait)
+	}
+
+	if cfg.Shards > 1 {
+		logger.Debug(logPrefix, "Enabling the sharded rate limiter")
+		return NewReservationMiddleware(krakendrate.NewShardedTokenBucket(cfg.MaxRate, cfg.Capacity, cfg.Shards), cfg.Wait)
+	}
+
+	tb := krakendrate.NewAtomicTokenBucket(cfg.MaxRate, cfg.Capacity)
 	logger.Debug(logPrefix, "Enabling the rate limiter")
+	return NewReservationMiddleware(tb, cfg.Wait)
+}
+
+// NewShaperMiddleware builds a middleware delaying the requests to the next proxy, so they
+// are released at the rate of the received leaky bucket
+func NewShaperMiddleware(lb *krakendrate.LeakyBucket) proxy.Middleware {
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
 		}
 		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
-			if !tb.Allow() {
+			if err := lb.Wait(ctx); err != nil {
 				return nil, krakendrate.ErrLimited
 			}
 			return next[0](ctx, request)
@@ -99,6 +127,75 @@ func NewMiddleware(logger logging.Logger, remote *config.Backend) proxy.Middlewa
 	}
 }
 
+// ReservationLimiter is the interface of the limiters used by the reservation middleware
+type ReservationLimiter interface {
+	krakendrate.Reserver
+	AllowN(uint64) bool
+	Refund(uint64)
+}
+
+// NewReservationMiddleware builds a middleware taking a token before calling the next proxy and
+// giving it back if the call is aborted or fails before reaching the upstream. If wait is true,
+// instead of rejecting the requests exceeding the rate, it reserves their token and waits for it as
+// long as it is available before the deadline of the request context. Requests without a deadline
+// are never delayed. The requests not waiting never reserve tokens in advance, so they do not put
+// the limiter into debt.
+func NewReservationMiddleware(l ReservationLimiter, wait bool) proxy.Middleware {
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			deadline, ok := ctx.Deadline()
+			if !wait || !ok {
+				if !l.AllowN(1) {
+					return nil, krakendrate.ErrLimited
+				}
+				resp, err := next[0](ctx, request)
+				if err != nil && !reachedUpstream(ctx, err) {
+					l.Refund(1)
+				}
+				return resp, err
+			}
+
+			r := l.Reserve(1)
+			if !r.OK() {
+				return nil, krakendrate.ErrLimited
+			}
+			if delay := r.Delay(); delay > 0 {
+				if deadline.Before(r.TimeToAct()) {
+					r.Cancel()
+					return nil, krakendrate.ErrLimited
+				}
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					r.Cancel()
+					return nil, krakendrate.ErrLimited
+				}
+			}
+
+			resp, err := next[0](ctx, request)
+			if err != nil && !reachedUpstream(ctx, err) {
+				r.Cancel()
+			}
+			return resp, err
+		}
+	}
+}
+
+// reachedUpstream reports if the error returned by the next proxy happened after the request
+// reached the upstream. Aborted calls and failed dials never reached it.
+func reachedUpstream(ctx context.Context, err error) bool {
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	return !errors.As(err, &opErr) || opErr.Op != "dial"
+}
+
 // ZeroCfg is the zero value for the Config struct
 var ZeroCfg = Config{}
 
@@ -118,6 +215,9 @@ func ConfigGetter(e config.ExtraConfig) (Config, error) {
 	if !ok {
 		return ZeroCfg, ErrWrongExtraCfg
 	}
+	if _, ok := tmp["cluster"]; ok {
+		return ZeroCfg, fmt.Errorf("%w: the backend limits can not be divided between the nodes of a cluster", ErrWrongExtraCfg)
+	}
 	cfg := Config{}
 	if v, ok := tmp["max_rate"]; ok {
 		switch val := v.(type) {
@@ -139,16 +239,69 @@ func ConfigGetter(e config.ExtraConfig) (Config, error) {
 			cfg.Capacity = uint64(val)
 		}
 	}
+	if v, ok := tmp["max_queue"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.MaxQueue = uint64(val)
+		case int:
+			cfg.MaxQueue = uint64(val)
+		case float64:
+			cfg.MaxQueue = uint64(val)
+		}
+	}
+	if v, ok := tmp["shards"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.Shards = uint64(val)
+		case int:
+			cfg.Shards = uint64(val)
+		case float64:
+			cfg.Shards = uint64(val)
+		}
+	}
+	if v, ok := tmp["wait"]; ok {
+		if b, ok := v.(bool); ok {
+			cfg.Wait = b
+		}
+	}
+	if v, ok := tmp["cold_rate"]; ok {
+		switch val := v.(type) {
+		case float64:
+			cfg.ColdRate = val
+		case int:
+			cfg.ColdRate = float64(val)
+		case int64:
+			cfg.ColdRate = float64(val)
+		}
+	}
+	if v, ok := tmp["warm_up"]; ok {
+		warmUp, err := time.ParseDuration(fmt.Sprintf("%v", v))
+		if err != nil {
+			return ZeroCfg, fmt.Errorf("%w: %s", ErrWrongExtraCfg, err.Error())
+		}
+		cfg.WarmUp = warmUp
+	}
 
 	factor := 1.0
 	if v, ok := tmp["every"]; ok {
 		every, err := time.ParseDuration(fmt.Sprintf("%v", v))
-		if err != nil {
+		if err != nil || every <= 0 {
 			every = time.Second
 		}
 		factor = float64(time.Second) / float64(every)
 	}
 	cfg.MaxRate = cfg.MaxRate * factor
+	cfg.ColdRate = cfg.ColdRate * factor
+	// by default, the backend limit starts at a third of its max rate
+	if cfg.WarmUp > 0 && cfg.ColdRate <= 0 {
+		cfg.ColdRate = cfg.MaxRate / 3
+	}
+	if cfg.MaxQueue > 0 && (cfg.WarmUp > 0 || cfg.Shards > 1) {
+		return ZeroCfg, fmt.Errorf("%w: max_queue can not be combined with warm_up or shards", ErrWrongExtraCfg)
+	}
+	if cfg.WarmUp > 0 && cfg.Shards > 1 {
+		return ZeroCfg, fmt.Errorf("%w: warm_up can not be combined with shards", ErrWrongExtraCfg)
+	}
 
 	return cfg, nil
 }
@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"net"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	krakendrate "github.com/krakend/krakend-ratelimit/v3"
 	"github.com/luraproject/lura/v2/config"
@@ -137,3 +140,193 @@ func dummyProxy(r *proxy.Response, err error) proxy.Proxy {
 		return r, err
 	}
 }
+
+func TestNewMiddleware_shaper(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(logging.NoOp, &config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"max_rate": 20.0, "max_queue": 2}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	})
+
+	request := proxy.Request{
+		Path: "/tupu",
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := p(context.Background(), &request); err != nil {
+			t.Errorf("request #%d: unexpected error: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("the requests were not delayed: %s", elapsed)
+	}
+	if calls != 3 {
+		t.Errorf("unexpected number of calls to the proxy: %d", calls)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p(ctx, &request); err != krakendrate.ErrLimited {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewMiddleware_wait(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(logging.NoOp, &config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"max_rate": 20.0, "capacity": 1, "wait": true}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	})
+
+	request := proxy.Request{
+		Path: "/tupu",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if _, err := p(ctx, &request); err != nil {
+			t.Errorf("request #%d: unexpected error: %v", i, err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("unexpected number of calls to the proxy: %d", calls)
+	}
+
+	if _, err := p(context.Background(), &request); err != krakendrate.ErrLimited {
+		t.Errorf("requests without deadline should not wait: %v", err)
+	}
+}
+
+func TestNewMiddleware_refund(t *testing.T) {
+	calls := uint64(0)
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	mdw := NewMiddleware(logging.NoOp, &config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"max_rate": 1.0, "capacity": 1.0}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddUint64(&calls, 1) < 3 {
+			return nil, dialErr
+		}
+		return nil, errors.New("upstream error")
+	})
+
+	request := proxy.Request{
+		Path: "/tupu",
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p(context.Background(), &request); err != dialErr {
+			t.Errorf("request #%d: unexpected error: %v", i, err)
+		}
+	}
+	if _, err := p(context.Background(), &request); err == nil || err == krakendrate.ErrLimited {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := p(context.Background(), &request); err != krakendrate.ErrLimited {
+		t.Errorf("the token consumed by a request reaching the upstream should not be refunded: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("unexpected number of calls to the proxy: %d", calls)
+	}
+}
+
+func TestNewMiddleware_shards(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(logging.NoOp, &config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"max_rate": 0.001, "capacity": 10, "shards": 4}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	})
+
+	request := proxy.Request{
+		Path: "/tupu",
+	}
+
+	var ko int
+	for i := 0; i < 100; i++ {
+		if _, err := p(context.Background(), &request); err == krakendrate.ErrLimited {
+			ko++
+		}
+	}
+	if calls != 10 || ko != 90 {
+		t.Errorf("unexpected results. calls: %d, ko: %d", calls, ko)
+	}
+}
+
+func TestNewMiddleware_warmUp(t *testing.T) {
+	calls := uint64(0)
+	mdw := NewMiddleware(logging.NoOp, &config.Backend{
+		ExtraConfig: map[string]interface{}{Namespace: map[string]interface{}{"max_rate": 0.003, "capacity": 30, "warm_up": "1h"}},
+	})
+	p := mdw(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddUint64(&calls, 1)
+		return &proxy.Response{}, nil
+	})
+
+	request := proxy.Request{
+		Path: "/tupu",
+	}
+
+	var ko int
+	for i := 0; i < 100; i++ {
+		if _, err := p(context.Background(), &request); err == krakendrate.ErrLimited {
+			ko++
+		}
+	}
+	// the initial stock is proportional to the default cold rate, a third of the max rate
+	if calls != 10 || ko != 90 {
+		t.Errorf("unexpected results. calls: %d, ko: %d", calls, ko)
+	}
+}
+
+func TestNewReservationMiddleware_noWait(t *testing.T) {
+	l := &spyReservationLimiter{ReservationLimiter: krakendrate.NewTokenBucket(0.001, 1)}
+	p := NewReservationMiddleware(l, false)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p(ctx, &proxy.Request{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := p(ctx, &proxy.Request{}); err != krakendrate.ErrLimited {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if l.reservations != 0 {
+		t.Errorf("the requests not waiting should not reserve tokens: %d", l.reservations)
+	}
+}
+
+type spyReservationLimiter struct {
+	ReservationLimiter
+	reservations int
+}
+
+func (s *spyReservationLimiter) Reserve(n uint64) *krakendrate.Reservation {
+	s.reservations++
+	return s.ReservationLimiter.Reserve(n)
+}
+
+func TestConfigGetter_conflicts(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"max_rate": 10.0, "max_queue": 10, "warm_up": "1m"},
+		{"max_rate": 10.0, "max_queue": 10, "shards": 4},
+		{"max_rate": 10.0, "warm_up": "1m", "shards": 4},
+		{"max_rate": 10.0, "cluster": map[string]interface{}{"peers": []interface{}{"10.0.0.2:7946"}}},
+	} {
+		if _, err := ConfigGetter(config.ExtraConfig{Namespace: cfg}); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %v: %v", cfg, err)
+		}
+	}
+}
@@ -15,7 +15,7 @@ func NewMemoryStore(maxRate float64, capacity int) LimiterStore {
 func NewLimiterStore(maxRate float64, capacity int, backend Backend) LimiterStore {
 	f := NewTokenBucketBuilder(maxRate, uint64(capacity), uint64(capacity), nil)
 	return func(t string) Limiter {
-		return backend.Load(t, f).(Limiter)
+		return asLimiter(backend.Load(t, f))
 	}
 }
 
@@ -30,6 +30,28 @@ func NewLimiterFromBackendAndBuilder(backend Backend, limiterBuilder LimiterBuil
 		limiterBuilder = NewTokenBucketBuilder(1, 1, 1, nil)
 	}
 	return func(strToken string) Limiter {
-		return backend.Load(strToken, limiterBuilder).(Limiter)
+		return asLimiter(backend.Load(strToken, limiterBuilder))
+	}
+}
+
+// asLimiter returns the received value as a Limiter. Values not implementing the interface, like
+// the ones returned by a wrong builder, are replaced by a limiter rejecting every request
+func asLimiter(v interface{}) Limiter {
+	if l, ok := v.(Limiter); ok {
+		return l
+	}
+	return rejectingLimiter{}
+}
+
+// rejectingLimiter is a Limiter rejecting every request
+type rejectingLimiter struct{}
+
+func (rejectingLimiter) Allow() bool { return false }
+
+// NewTypedLimiterStore creates a LimiterStore persisting the limiters created by the received
+// builder in a TypedBackend, so no type assertion is required for loading them
+func NewTypedLimiterStore[T Limiter](backend TypedBackend[T], limiterBuilder func() T) LimiterStore {
+	return func(strToken string) Limiter {
+		return backend.Load(strToken, limiterBuilder)
 	}
 }
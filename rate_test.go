@@ -1,6 +1,10 @@
 package krakendrate
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestNewMemoryStore(t *testing.T) {
 	store := NewMemoryStore(1, 1)
@@ -18,3 +22,33 @@ func TestNewMemoryStore(t *testing.T) {
 		t.Error("The limiter should allow the fourth call because it requests a new limiter")
 	}
 }
+
+func TestNewTypedLimiterStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := NewTypedShardedBackend(ctx, 16, time.Minute, time.Minute, 1, PseudoFNV64a,
+		TypedMemoryBackendBuilder[*TokenBucket])
+	store := NewTypedLimiterStore(backend, func() *TokenBucket { return NewTokenBucket(1, 1) })
+
+	if !store("1").Allow() {
+		t.Error("The limiter should allow the first call")
+	}
+	if store("1").Allow() {
+		t.Error("The limiter should block the second call")
+	}
+	if !store("2").Allow() {
+		t.Error("The limiter should allow the third call because it requests a new limiter")
+	}
+	if tb := backend.Load("1", nil); tb.State().Remaining != 0 {
+		t.Errorf("unexpected state of the stored bucket: %+v", tb.State())
+	}
+}
+
+func TestNewLimiterFromBackendAndBuilder_wrongBuilder(t *testing.T) {
+	backend := NewMemoryBackend(context.Background(), time.Minute)
+	store := NewLimiterFromBackendAndBuilder(backend, func() interface{} { return "not a limiter" })
+	if store("a").Allow() {
+		t.Error("the values not implementing the Limiter interface should reject the requests")
+	}
+}
@@ -0,0 +1,185 @@
+// Package redis contains limiter stores keeping their state in a Redis server, so all the
+// instances of a cluster share the same limits
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+)
+
+// Options define the behaviour of the limiters of a Redis store
+type Options struct {
+	// KeyPrefix is prepended to the keys of the limiters
+	KeyPrefix string
+	// Timeout is the maximum duration of every call to Redis. Zero means no timeout
+	Timeout time.Duration
+	// FailOpen allows the requests when Redis can not be reached. Otherwise, they are rejected
+	FailOpen bool
+}
+
+// NewTokenBucketStore returns a LimiterStore whose limiters are token buckets with the given rate
+// and capacity, stored in Redis and updated atomically by a Lua script. The idle buckets expire
+// once they are full again.
+func NewTokenBucketStore(client goredis.Scripter, rate float64, capacity uint64, opts Options) krakendrate.LimiterStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if rate <= 0 {
+		rate = 1e-9
+	}
+	args := []interface{}{rate, capacity, 1, bucketTTL(rate, capacity).Milliseconds()}
+
+	return func(key string) krakendrate.Limiter {
+		return &Limiter{
+			client: client,
+			script: tokenBucketScript,
+			key:    opts.KeyPrefix + key,
+			args:   args,
+			opts:   opts,
+		}
+	}
+}
+
+// NewSlidingWindowStore returns a LimiterStore whose limiters are sliding window logs accepting up to
+// limit requests in any window of the given size, stored in Redis and updated atomically by a Lua script
+func NewSlidingWindowStore(client goredis.Scripter, limit uint64, window time.Duration, opts Options) krakendrate.LimiterStore {
+	if limit < 1 {
+		limit = 1
+	}
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+
+	return func(key string) krakendrate.Limiter {
+		return &Limiter{
+			client:  client,
+			script:  slidingWindowScript,
+			key:     opts.KeyPrefix + key,
+			args:    []interface{}{limit, window.Microseconds()},
+			opts:    opts,
+			members: true,
+		}
+	}
+}
+
+// NewTokenLeaser returns a krakendrate.TokenLeaser granting batches of tokens from token buckets
+// with the given rate and capacity, stored in Redis. The buckets are shared with the limiters of
+// the stores returned by NewTokenBucketStore with the same prefix, rate and capacity.
+func NewTokenLeaser(client goredis.Scripter, rate float64, capacity uint64, opts Options) *TokenLeaser {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if rate <= 0 {
+		rate = 1e-9
+	}
+	return &TokenLeaser{
+		client:   client,
+		rate:     rate,
+		capacity: capacity,
+		ttl:      bucketTTL(rate, capacity),
+		opts:     opts,
+	}
+}
+
+// TokenLeaser grants batches of tokens from the token buckets stored in Redis
+type TokenLeaser struct {
+	client   goredis.Scripter
+	rate     float64
+	capacity uint64
+	ttl      time.Duration
+	opts     Options
+}
+
+// Lease takes up to n tokens from the bucket of the key and returns the amount granted
+func (t *TokenLeaser) Lease(ctx context.Context, key string, n uint64) (uint64, error) {
+	if n > math.MaxInt64 {
+		n = math.MaxInt64
+	}
+	res, err := t.run(ctx, key, int64(n))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(res), nil
+}
+
+// Release gives n unused tokens back to the bucket of the key
+func (t *TokenLeaser) Release(ctx context.Context, key string, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	if n > math.MaxInt64 {
+		n = math.MaxInt64
+	}
+	_, err := t.run(ctx, key, -int64(n))
+	return err
+}
+
+func (t *TokenLeaser) run(ctx context.Context, key string, n int64) (int64, error) {
+	args := []interface{}{t.rate, t.capacity, n, t.ttl.Milliseconds()}
+	return leaseScript.Run(ctx, t.client, []string{t.opts.KeyPrefix + key}, args...).Int64()
+}
+
+// bucketTTL returns the expiration of the idle buckets: they are full again after capacity/rate
+// seconds
+func bucketTTL(rate float64, capacity uint64) time.Duration {
+	ttl := time.Duration(float64(capacity) / rate * float64(time.Second))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// Limiter is a limiter whose state is kept in Redis
+type Limiter struct {
+	client goredis.Scripter
+	script *goredis.Script
+	key    string
+	args   []interface{}
+	opts   Options
+	// members flags if every call requires a unique member for the sorted set of the window
+	members bool
+}
+
+// Allow flags if the current request can be processed or not. When Redis fails, the request is
+// allowed if the store is configured to fail open
+func (l *Limiter) Allow() bool {
+	ctx := context.Background()
+	if l.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.opts.Timeout)
+		defer cancel()
+	}
+	ok, err := l.AllowContext(ctx)
+	if err != nil {
+		return l.opts.FailOpen
+	}
+	return ok
+}
+
+// AllowContext flags if the current request can be processed or not, reporting the errors of Redis
+func (l *Limiter) AllowContext(ctx context.Context) (bool, error) {
+	args := l.args
+	if l.members {
+		args = append(args[:len(args):len(args)], uniqueMember())
+	}
+	res, err := l.script.Run(ctx, l.client, []string{l.key}, args...).Int64()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// uniqueMember returns a random identifier, so the requests accepted at the same microsecond are
+// not collapsed into a single member of the window
+func uniqueMember() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
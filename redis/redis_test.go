@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func newTestServer(t *testing.T) (*miniredis.Miniredis, *goredis.Client) {
+	s := miniredis.RunT(t)
+	s.SetTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { c.Close() })
+	return s, c
+}
+
+func TestNewTokenBucketStore(t *testing.T) {
+	s, c := newTestServer(t)
+	store := NewTokenBucketStore(c, 10, 5, Options{KeyPrefix: "rl:"})
+
+	// two instances sharing the same redis share the same buckets
+	for i := 0; i < 5; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if NewTokenBucketStore(c, 10, 5, Options{KeyPrefix: "rl:"})("a").Allow() {
+		t.Error("the bucket should be empty for all the instances")
+	}
+	if !store("b").Allow() {
+		t.Error("every key should have its own bucket")
+	}
+
+	s.SetTime(time.Date(2024, 1, 1, 0, 0, 0, 250*int(time.Millisecond), time.UTC))
+	for i := 0; i < 2; i++ {
+		if !store("a").Allow() {
+			t.Errorf("refilled request #%d should be allowed", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the bucket should be empty after consuming the refill")
+	}
+	if !s.Exists("rl:a") {
+		t.Error("the bucket should be stored with the prefix")
+	}
+	if ttl := s.TTL("rl:a"); ttl <= 0 || ttl > time.Second {
+		t.Errorf("unexpected ttl: %s", ttl)
+	}
+}
+
+func TestNewSlidingWindowStore(t *testing.T) {
+	s, c := newTestServer(t)
+	store := NewSlidingWindowStore(c, 3, time.Minute, Options{})
+
+	for i := 0; i < 3; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+		s.SetTime(time.Date(2024, 1, 1, 0, 0, 10*(i+1), 0, time.UTC))
+	}
+	if store("a").Allow() {
+		t.Error("the window should be full")
+	}
+
+	// the first request leaves the window one minute after it was accepted
+	s.SetTime(time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC))
+	if !store("a").Allow() {
+		t.Error("the request should be allowed once the first one leaves the window")
+	}
+	if store("a").Allow() {
+		t.Error("the window should be full again")
+	}
+}
+
+func TestTokenLeaser(t *testing.T) {
+	s, c := newTestServer(t)
+	ctx := context.Background()
+	leaser := NewTokenLeaser(c, 10, 25, Options{KeyPrefix: "rl:"})
+
+	for _, want := range []uint64{10, 10, 5, 0} {
+		got, err := leaser.Lease(ctx, "a", 10)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if got != want {
+			t.Errorf("unexpected lease. have: %d, want: %d", got, want)
+		}
+	}
+
+	if err := leaser.Release(ctx, "a", 4); err != nil {
+		t.Error(err)
+	}
+	// the bucket is shared with the limiters of the token bucket store
+	store := NewTokenBucketStore(c, 10, 25, Options{KeyPrefix: "rl:"})
+	for i := 0; i < 4; i++ {
+		if !store("a").Allow() {
+			t.Errorf("released token #%d should be available", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the bucket should be empty")
+	}
+
+	s.SetTime(time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC))
+	if got, _ := leaser.Lease(ctx, "a", 20); got != 10 {
+		t.Errorf("unexpected lease after the refill: %d", got)
+	}
+}
+
+func TestLimiter_failures(t *testing.T) {
+	s, c := newTestServer(t)
+	closed := NewTokenBucketStore(c, 10, 5, Options{Timeout: 100 * time.Millisecond})
+	open := NewTokenBucketStore(c, 10, 5, Options{Timeout: 100 * time.Millisecond, FailOpen: true})
+	s.Close()
+
+	if closed("a").Allow() {
+		t.Error("the request should be rejected when redis is not available")
+	}
+	if !open("a").Allow() {
+		t.Error("the request should be allowed when redis is not available and the store fails open")
+	}
+}
@@ -0,0 +1,104 @@
+package redis
+
+import (
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript refills and consumes the bucket stored in the hash KEYS[1], using the clock
+// of the Redis server so all the instances agree on the time.
+//
+// ARGV: rate (tokens per second), capacity, cost, ttl (ms)
+// Returns: 1 if the request is allowed, 0 otherwise
+var tokenBucketScript = goredis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate / 1000000)
+	ts = now
+end
+
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', string.format('%.17g', tokens), 'ts', string.format('%d', ts))
+redis.call('PEXPIRE', KEYS[1], ttl)
+return allowed
+`)
+
+// slidingWindowScript keeps the log of the requests accepted during the last window in the sorted
+// set KEYS[1], scored by their timestamp in the clock of the Redis server.
+//
+// ARGV: limit, window (µs), unique member for the request
+// Returns: 1 if the request is allowed, 0 otherwise
+var slidingWindowScript = goredis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+if count >= limit then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[3])
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+return 1
+`)
+
+// leaseScript refills the bucket stored in the hash KEYS[1] like tokenBucketScript, and then
+// takes up to n whole tokens from it or, when n is negative, gives -n tokens back to it.
+//
+// ARGV: rate (tokens per second), capacity, n, ttl (ms)
+// Returns: the amount of tokens granted
+var leaseScript = goredis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate / 1000000)
+	ts = now
+end
+
+local granted = 0
+if n < 0 then
+	tokens = math.min(capacity, tokens - n)
+else
+	granted = math.max(0, math.min(n, math.floor(tokens)))
+	tokens = tokens - granted
+end
+
+redis.call('HSET', KEYS[1], 'tokens', string.format('%.17g', tokens), 'ts', string.format('%d', ts))
+redis.call('PEXPIRE', KEYS[1], ttl)
+return granted
+`)
@@ -0,0 +1,55 @@
+package krakendrate
+
+import (
+	"sync"
+	"time"
+)
+
+// Reserver is the interface of the limiters able to reserve tokens in advance
+type Reserver interface {
+	Reserve(uint64) *Reservation
+}
+
+// Reservation holds the information about some tokens reserved in a limiter
+type Reservation struct {
+	ok        bool
+	tokens    uint64
+	timeToAct time.Time
+	clock     Clock
+	refund    func(uint64)
+	once      sync.Once
+}
+
+// OK returns whether the limiter can provide the requested tokens. If OK is false, the
+// reservation holds no tokens and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// TimeToAct returns the instant when the reserved tokens become available
+func (r *Reservation) TimeToAct() time.Time {
+	return r.timeToAct
+}
+
+// Delay returns the time to wait until the reserved tokens become available. A zero
+// delay means the tokens can be used right now.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+	if d := r.timeToAct.Sub(r.clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Cancel gives the reserved tokens back to the limiter. It is safe to call it several
+// times, but the tokens are only returned once.
+func (r *Reservation) Cancel() {
+	if !r.ok {
+		return
+	}
+	r.once.Do(func() {
+		r.refund(r.tokens)
+	})
+}
@@ -0,0 +1,68 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(10, 2, clk)
+
+	r := tb.Reserve(2)
+	if !r.OK() {
+		t.Error("the reservation should be ok")
+	}
+	if d := r.Delay(); d != 0 {
+		t.Errorf("the tokens should be available right now. delay: %s", d)
+	}
+
+	r = tb.Reserve(2)
+	if !r.OK() {
+		t.Error("the reservation should be ok")
+	}
+	if d := r.Delay(); d != 200*time.Millisecond {
+		t.Errorf("unexpected delay: %s", d)
+	}
+
+	next := tb.Reserve(1)
+	if d := next.Delay(); d != 300*time.Millisecond {
+		t.Errorf("the reservations should be queued. delay: %s", d)
+	}
+
+	if tb.Allow() {
+		t.Error("the bucket should be in debt")
+	}
+
+	r.Cancel()
+	next.Cancel()
+	next.Cancel()
+	clk.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the refunded tokens should be available after the refill")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+
+	if r := tb.Reserve(3); r.OK() {
+		t.Error("reservations exceeding the capacity should not be ok")
+	}
+}
+
+func TestTokenBucket_ReserveCancel(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(1, 5, clk)
+
+	r := tb.Reserve(3)
+	if !tb.AllowN(2) {
+		t.Error("2 tokens should remain in the bucket")
+	}
+	r.Cancel()
+	if !tb.AllowN(3) {
+		t.Error("the cancelled tokens should be back in the bucket")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+}
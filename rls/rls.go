@@ -0,0 +1,87 @@
+// Package rls contains a client of the rate limit services implementing the ShouldRateLimit gRPC
+// API of Envoy, so the limits can be enforced by an existing global rate limit service
+package rls
+
+import (
+	"context"
+	"time"
+
+	commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+)
+
+// Entry is a key-value pair of a descriptor
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Descriptor is the ordered list of entries identifying a limit of the rate limit service
+type Descriptor []Entry
+
+// Options define the behaviour of the client
+type Options struct {
+	// Domain is the domain of the limits in the rate limit service
+	Domain string
+	// Timeout is the maximum duration of every call to the service. Zero means no timeout
+	Timeout time.Duration
+	// FailOpen allows the requests when the service fails. Otherwise, they are rejected
+	FailOpen bool
+}
+
+// Client calls the ShouldRateLimit API of a rate limit service
+type Client struct {
+	client rlsv3.RateLimitServiceClient
+	opts   Options
+}
+
+// New returns a client of the rate limit service reachable through the received connection
+func New(conn grpc.ClientConnInterface, opts Options) *Client {
+	return &Client{
+		client: rlsv3.NewRateLimitServiceClient(conn),
+		opts:   opts,
+	}
+}
+
+// Allow flags if a request matching the descriptors can be processed or not, consuming hits units
+// of every limit. When the service fails, the request is allowed if the client is configured to
+// fail open
+func (c *Client) Allow(ctx context.Context, descriptors []Descriptor, hits uint32) bool {
+	if c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	ok, err := c.ShouldRateLimit(ctx, descriptors, hits)
+	if err != nil {
+		return c.opts.FailOpen
+	}
+	return ok
+}
+
+// ShouldRateLimit calls the service with the descriptors and returns if the request can be
+// processed, reporting the errors of the call. A request without descriptors is always allowed
+func (c *Client) ShouldRateLimit(ctx context.Context, descriptors []Descriptor, hits uint32) (bool, error) {
+	if len(descriptors) == 0 {
+		return true, nil
+	}
+	req := &rlsv3.RateLimitRequest{
+		Domain:      c.opts.Domain,
+		Descriptors: make([]*commonv3.RateLimitDescriptor, 0, len(descriptors)),
+		HitsAddend:  hits,
+	}
+	for _, d := range descriptors {
+		rd := &commonv3.RateLimitDescriptor{Entries: make([]*commonv3.RateLimitDescriptor_Entry, len(d))}
+		for i, e := range d {
+			rd.Entries[i] = &commonv3.RateLimitDescriptor_Entry{Key: e.Key, Value: e.Value}
+		}
+		req.Descriptors = append(req.Descriptors, rd)
+	}
+
+	resp, err := c.client.ShouldRateLimit(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	return resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT, nil
+}
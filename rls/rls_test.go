@@ -0,0 +1,139 @@
+package rls
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestClient(t *testing.T) {
+	srv := newFakeServer(t, map[string]uint64{"user=alice": 2, "path=/slow": 3})
+	c := New(dial(t, srv.addr), Options{Domain: "krakend", Timeout: time.Second})
+	ctx := context.Background()
+
+	alice := []Descriptor{{{Key: "user", Value: "alice"}}, {{Key: "path", Value: "/slow"}}}
+	for i := 0; i < 2; i++ {
+		if !c.Allow(ctx, alice, 1) {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if c.Allow(ctx, alice, 1) {
+		t.Error("the user limit should be exhausted")
+	}
+
+	bob := []Descriptor{{{Key: "user", Value: "bob"}}, {{Key: "path", Value: "/slow"}}}
+	if !c.Allow(ctx, bob, 1) {
+		t.Error("every user should have its own limit")
+	}
+	if c.Allow(ctx, bob, 1) {
+		t.Error("the path limit should be exhausted")
+	}
+	if !c.Allow(ctx, nil, 1) {
+		t.Error("the requests without descriptors should be allowed")
+	}
+
+	req := srv.lastRequest()
+	if req.GetDomain() != "krakend" || len(req.GetDescriptors()) != 2 || req.GetHitsAddend() != 1 {
+		t.Errorf("unexpected request: %v", req)
+	}
+}
+
+func TestClient_failures(t *testing.T) {
+	srv := newFakeServer(t, nil)
+	conn := dial(t, srv.addr)
+	srv.stop()
+
+	descriptors := []Descriptor{{{Key: "user", Value: "alice"}}}
+	ctx := context.Background()
+	if New(conn, Options{Timeout: 100 * time.Millisecond}).Allow(ctx, descriptors, 1) {
+		t.Error("the request should be rejected when the service is not available")
+	}
+	if !New(conn, Options{Timeout: 100 * time.Millisecond, FailOpen: true}).Allow(ctx, descriptors, 1) {
+		t.Error("the request should be allowed when the service is not available and the client fails open")
+	}
+	if _, err := New(conn, Options{Timeout: 100 * time.Millisecond}).ShouldRateLimit(ctx, descriptors, 1); err == nil {
+		t.Error("the error should be reported")
+	}
+}
+
+func dial(t *testing.T, addr string) *grpc.ClientConn {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeServer is an in-process rate limit service with a fixed amount of hits per descriptor,
+// identified by its entries joined as key=value pairs
+type fakeServer struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	addr   string
+	srv    *grpc.Server
+	limits map[string]uint64
+	hits   map[string]uint64
+	last   *rlsv3.RateLimitRequest
+	mu     sync.Mutex
+}
+
+func newFakeServer(t *testing.T, limits map[string]uint64) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		addr:   l.Addr().String(),
+		srv:    grpc.NewServer(),
+		limits: limits,
+		hits:   map[string]uint64{},
+	}
+	rlsv3.RegisterRateLimitServiceServer(s.srv, s)
+	go s.srv.Serve(l)
+	t.Cleanup(s.stop)
+	return s
+}
+
+func (s *fakeServer) stop() {
+	s.srv.Stop()
+}
+
+func (s *fakeServer) lastRequest() *rlsv3.RateLimitRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *fakeServer) ShouldRateLimit(_ context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = req
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	keys := make([]string, 0, len(req.GetDescriptors()))
+	for _, d := range req.GetDescriptors() {
+		entries := make([]string, 0, len(d.GetEntries()))
+		for _, e := range d.GetEntries() {
+			entries = append(entries, e.GetKey()+"="+e.GetValue())
+		}
+		key := strings.Join(entries, ",")
+		keys = append(keys, key)
+		if limit, ok := s.limits[key]; ok && s.hits[key]+uint64(req.GetHitsAddend()) > limit {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+	}
+	// like the envoy service, the hits are only consumed when the request is allowed
+	if resp.OverallCode == rlsv3.RateLimitResponse_OK {
+		for _, k := range keys {
+			s.hits[k] += uint64(req.GetHitsAddend())
+		}
+	}
+	return resp, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/luraproject/lura/v2/config"
@@ -51,6 +52,11 @@ func applyGlobalRateLimit(logger logging.Logger, logPrefix string, cfg router.Co
 		return handler
 	}
 
+	if cfg.MaxQueue > 0 {
+		logger.Debug(logPrefix, fmt.Sprintf("Rate shaping enabled. MaxRate: %f, MaxQueue: %d", cfg.MaxRate, cfg.MaxQueue))
+		return NewEndpointShaperMw(krakendrate.NewLeakyBucket(cfg.MaxRate, cfg.MaxQueue))(handler)
+	}
+
 	if cfg.Capacity == 0 {
 		if cfg.MaxRate < 1 {
 			cfg.Capacity = 1
@@ -59,13 +65,60 @@ func applyGlobalRateLimit(logger logging.Logger, logPrefix string, cfg router.Co
 		}
 	}
 
+	divider, err := router.DividerFromCfg(cfg)
+	if err != nil {
+		logger.Error(logPrefix, "Enforcing the whole limit locally:", err)
+	}
+
+	if cfg.WarmUp > 0 {
+		logger.Debug(logPrefix, fmt.Sprintf("Rate limit enabled. MaxRate: %f, Capacity: %d, ColdRate: %f, WarmUp: %s",
+			cfg.MaxRate, cfg.Capacity, cfg.ColdRate, cfg.WarmUp))
+		tb := krakendrate.NewWarmUpTokenBucket(cfg.MaxRate, cfg.ColdRate, cfg.Capacity, cfg.WarmUp)
+		if divider != nil {
+			divider.WarmUpBucket(tb, cfg.MaxRate, cfg.ColdRate, cfg.Capacity)
+		}
+		return NewEndpointLimiterWithCostMw(tb, costFnFromCfg(cfg))(handler)
+	}
+
+	if divider != nil {
+		logger.Debug(logPrefix, fmt.Sprintf("Rate limit enabled. MaxRate: %f, Capacity: %d, Cluster size: %d",
+			cfg.MaxRate, cfg.Capacity, divider.Size()))
+		tb := krakendrate.NewAtomicTokenBucket(cfg.MaxRate, cfg.Capacity)
+		divider.Bucket(tb, cfg.MaxRate, cfg.Capacity)
+		return NewEndpointLimiterWithCostMw(tb, costFnFromCfg(cfg))(handler)
+	}
+
+	if cfg.GlobalShards > 1 {
+		logger.Debug(logPrefix, fmt.Sprintf("Rate limit enabled. MaxRate: %f, Capacity: %d, Shards: %d",
+			cfg.MaxRate, cfg.Capacity, cfg.GlobalShards))
+		tb := krakendrate.NewShardedTokenBucket(cfg.MaxRate, cfg.Capacity, cfg.GlobalShards)
+		return NewEndpointLimiterWithCostMw(tb, costFnFromCfg(cfg))(handler)
+	}
+
 	logger.Debug(logPrefix, fmt.Sprintf("Rate limit enabled. MaxRate: %f, Capacity: %d", cfg.MaxRate, cfg.Capacity))
-	return NewEndpointRateLimiterMw(krakendrate.NewTokenBucket(cfg.MaxRate, cfg.Capacity))(handler)
+	tb := krakendrate.NewAtomicTokenBucket(cfg.MaxRate, cfg.Capacity)
+	return NewEndpointLimiterWithCostMw(tb, costFnFromCfg(cfg))(handler)
 }
 
 func applyClientRateLimit(logger logging.Logger, logPrefix string, cfg router.Config,
 	handler gin.HandlerFunc,
 ) gin.HandlerFunc {
+	if cfg.Backend == "rls" {
+		client, err := router.RLSClientFromCfg(cfg)
+		if err != nil {
+			logger.Error(logPrefix, err)
+			return rlsFailureHandler(cfg, handler)
+		}
+		descriptors, err := DescriptorsFnFromCfg(cfg)
+		if err != nil {
+			logger.Error(logPrefix, err)
+			return rlsFailureHandler(cfg, handler)
+		}
+		logger.Debug(logPrefix, fmt.Sprintf("Rate limit service enabled. Address: %s, Domain: %s, Descriptors: %d",
+			cfg.RLS.Address, cfg.RLS.Domain, len(cfg.RLS.Descriptors)))
+		return NewRLSLimiterMw(client, descriptors)(handler)
+	}
+
 	if cfg.ClientMaxRate <= 0 {
 		return handler
 	}
@@ -85,9 +138,31 @@ func applyClientRateLimit(logger logging.Logger, logPrefix string, cfg router.Co
 	logger.Debug(logPrefix,
 		fmt.Sprintf("Rate limit enabled. Strategy: %s (key: %s), MaxRate: %f, Capacity: %d",
 			cfg.Strategy, cfg.Key, cfg.ClientMaxRate, cfg.ClientCapacity))
-	store := router.StoreFromCfg(cfg)
+	store, err := router.NewStoreFromCfg(cfg)
+	if err != nil {
+		logger.Error(logPrefix, "Enforcing the limits locally:", err)
+		store = router.LocalStoreFromCfg(cfg)
+	}
+
+	return NewTokenLimiterWithCostMw(tokenExtractor, store, costFnFromCfg(cfg))(handler)
+}
+
+// rlsFailureHandler returns the handler to use when the rate limit service can not be set up: the
+// received one if the config fails open, or one rejecting all the requests otherwise
+func rlsFailureHandler(cfg router.Config, handler gin.HandlerFunc) gin.HandlerFunc {
+	if cfg.RLS.FailOpen {
+		return handler
+	}
+	return func(c *gin.Context) {
+		c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
+	}
+}
 
-	return NewTokenLimiterMw(tokenExtractor, store)(handler)
+func costFnFromCfg(cfg router.Config) CostFn {
+	if cfg.CostHeader == "" {
+		return nil
+	}
+	return HeaderCostFn(cfg.CostHeader)
 }
 
 // EndpointMw is a function that decorates the received handlerFunc with some rateliming logic
@@ -95,9 +170,135 @@ type EndpointMw func(gin.HandlerFunc) gin.HandlerFunc
 
 // NewEndpointRateLimiterMw creates a simple ratelimiter for a given handlerFunc
 func NewEndpointRateLimiterMw(tb *krakendrate.TokenBucket) EndpointMw {
+	return NewEndpointLimiterMw(tb)
+}
+
+// NewEndpointLimiterMw creates a simple ratelimiter for a given handlerFunc using the received limiter
+func NewEndpointLimiterMw(l krakendrate.Limiter) EndpointMw {
+	return NewEndpointLimiterWithCostMw(l, nil)
+}
+
+// NewEndpointLimiterWithCostMw creates a simple ratelimiter for a given handlerFunc using the received
+// limiter. Once the request is processed, the limiter is charged with the real cost of the request
+// returned by the CostFn, if any
+func NewEndpointLimiterWithCostMw(l krakendrate.Limiter, cost CostFn) EndpointMw {
 	return func(next gin.HandlerFunc) gin.HandlerFunc {
 		return func(c *gin.Context) {
-			if !tb.Allow() {
+			if !l.Allow() {
+				c.AbortWithError(503, krakendrate.ErrLimited)
+				return
+			}
+			processWithCost(c, next, l, cost)
+		}
+	}
+}
+
+// CostFn returns the real cost of a request, in tokens, once it has been processed. The returned
+// flag is false when the cost is unknown, so the request just keeps the token already taken
+type CostFn func(*gin.Context) (uint64, bool)
+
+// HeaderCostFn returns a CostFn reading the cost of the requests from the received response header.
+// The header is removed, so it is not sent to the client, and the cost is kept in the context for
+// the rest of the limiters of the request
+func HeaderCostFn(header string) CostFn {
+	key := "krakend-ratelimit-cost:" + header
+	return func(c *gin.Context) (uint64, bool) {
+		if v, ok := c.Get(key); ok {
+			n, ok := v.(uint64)
+			return n, ok
+		}
+		v := c.Writer.Header().Get(header)
+		if v == "" {
+			return 0, false
+		}
+		c.Writer.Header().Del(header)
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		c.Set(key, n)
+		return n, true
+	}
+}
+
+// processWithCost processes the request with the next handler and adjusts the tokens taken from
+// the limiter to its real cost. The cost is evaluated right before the response headers are sent,
+// so the CostFn can still remove the headers used internally
+func processWithCost(c *gin.Context, next gin.HandlerFunc, l krakendrate.Limiter, cost CostFn) {
+	if cost == nil {
+		next(c)
+		return
+	}
+	w := &costWriter{ResponseWriter: c.Writer, ctx: c, cost: cost}
+	c.Writer = w
+	next(c)
+	c.Writer = w.ResponseWriter
+	w.evaluate()
+	if w.ok {
+		chargeCost(l, w.n)
+	}
+}
+
+// chargeCost adjusts the tokens taken from the limiter to the real cost of the request: the extra
+// tokens are charged to limiters implementing the ChargeableLimiter interface, so they may go
+// into debt, and the token of a request without cost is refunded
+func chargeCost(l krakendrate.Limiter, n uint64) {
+	switch {
+	case n > 1:
+		if cl, ok := l.(krakendrate.ChargeableLimiter); ok {
+			cl.Charge(n - 1)
+		}
+	case n == 0:
+		if r, ok := l.(krakendrate.RefundableLimiter); ok {
+			r.Refund(1)
+		}
+	}
+}
+
+// costWriter evaluates the cost of the request once, right before the response headers are sent
+type costWriter struct {
+	gin.ResponseWriter
+	ctx       *gin.Context
+	cost      CostFn
+	evaluated bool
+	n         uint64
+	ok        bool
+}
+
+func (w *costWriter) evaluate() {
+	if w.evaluated {
+		return
+	}
+	w.evaluated = true
+	w.n, w.ok = w.cost(w.ctx)
+}
+
+func (w *costWriter) WriteHeaderNow() {
+	w.evaluate()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *costWriter) Write(data []byte) (int, error) {
+	w.evaluate()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *costWriter) WriteString(s string) (int, error) {
+	w.evaluate()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *costWriter) Flush() {
+	w.evaluate()
+	w.ResponseWriter.Flush()
+}
+
+// NewEndpointShaperMw creates a simple rate shaper for a given handlerFunc. The requests exceeding the
+// rate are delayed until the leaky bucket releases them, and only rejected when its queue is full
+func NewEndpointShaperMw(lb *krakendrate.LeakyBucket) EndpointMw {
+	return func(next gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if err := lb.Wait(c.Request.Context()); err != nil {
 				c.AbortWithError(503, krakendrate.ErrLimited)
 				return
 			}
@@ -145,6 +346,13 @@ func NewIpLimiterWithKeyMwFromCfg(cfg router.Config) EndpointMw {
 
 // NewTokenLimiterMw returns a token based ratelimiting endpoint middleware with the received TokenExtractor and LimiterStore
 func NewTokenLimiterMw(tokenExtractor TokenExtractor, limiterStore krakendrate.LimiterStore) EndpointMw {
+	return NewTokenLimiterWithCostMw(tokenExtractor, limiterStore, nil)
+}
+
+// NewTokenLimiterWithCostMw returns a token based ratelimiting endpoint middleware with the received
+// TokenExtractor and LimiterStore. Once the request is processed, the limiter of the token is charged
+// with the real cost of the request returned by the CostFn, if any
+func NewTokenLimiterWithCostMw(tokenExtractor TokenExtractor, limiterStore krakendrate.LimiterStore, cost CostFn) EndpointMw {
 	return func(next gin.HandlerFunc) gin.HandlerFunc {
 		return func(c *gin.Context) {
 			tokenKey := tokenExtractor(c)
@@ -152,11 +360,12 @@ func NewTokenLimiterMw(tokenExtractor TokenExtractor, limiterStore krakendrate.L
 				c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
 				return
 			}
-			if !limiterStore(tokenKey).Allow() {
+			l := limiterStore(tokenKey)
+			if !l.Allow() {
 				c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
 				return
 			}
-			next(c)
+			processWithCost(c, next, l, cost)
 		}
 	}
 }
@@ -4,8 +4,10 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/krakend/krakend-ratelimit/v3/router"
@@ -134,3 +136,232 @@ func testRateLimiterMw(t *testing.T, rd requestDecorator, cfg *config.EndpointCo
 		t.Errorf("not all the requests were tracked: %d/%d", ok, ko)
 	}
 }
+
+func TestNewRateLimiterMw_shaper(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"max_rate":  20,
+				"max_queue": 4,
+			},
+		},
+	}
+
+	var hits int64
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&hits, 1)
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	var wg sync.WaitGroup
+	var ok, ko int64
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", http.NoBody)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			switch w.Result().StatusCode {
+			case 200:
+				atomic.AddInt64(&ok, 1)
+			case 503:
+				atomic.AddInt64(&ko, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok != 5 || ko != 5 {
+		t.Errorf("unexpected results. ok: %d, ko: %d", ok, ko)
+	}
+	if hits != ok {
+		t.Errorf("hits do not match the tracked oks: %d/%d", hits, ok)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the queued requests were released too soon: %s", elapsed)
+	}
+}
+
+func TestNewRateLimiterMw_globalShards(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"max_rate":      0.001,
+				"capacity":      100,
+				"global_shards": 8,
+			},
+		},
+	}
+
+	var hits int64
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&hits, 1)
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	var ok, ko int64
+	for i := 0; i < 1000; i++ {
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		switch w.Result().StatusCode {
+		case 200:
+			ok++
+		case 503:
+			ko++
+		}
+	}
+
+	if ok != 100 || ko != 900 {
+		t.Errorf("the aggregated capacity of the shards should be enforced. ok: %d, ko: %d", ok, ko)
+	}
+	if hits != ok {
+		t.Errorf("hits do not match the tracked oks: %d/%d", hits, ok)
+	}
+}
+
+func TestNewRateLimiterMw_warmUp(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"max_rate":  0.004,
+				"capacity":  100,
+				"cold_rate": 0.001,
+				"warm_up":   "1h",
+			},
+		},
+	}
+
+	var hits int64
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&hits, 1)
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	var ok, ko int64
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		switch w.Result().StatusCode {
+		case 200:
+			ok++
+		case 503:
+			ko++
+		}
+	}
+
+	if ok != 25 || ko != 75 {
+		t.Errorf("the initial stock should be proportional to the cold rate. ok: %d, ko: %d", ok, ko)
+	}
+	if hits != ok {
+		t.Errorf("hits do not match the tracked oks: %d/%d", hits, ok)
+	}
+}
+
+func TestNewRateLimiterMw_cluster(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"max_rate": 0.001,
+				"capacity": 100,
+				"cluster": map[string]interface{}{
+					"peers": []interface{}{"10.0.0.2:7946", "10.0.0.3:7946", "10.0.0.4:7946"},
+				},
+			},
+		},
+	}
+
+	var hits int64
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&hits, 1)
+		return &proxy.Response{}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	var ok, ko int64
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		switch w.Result().StatusCode {
+		case 200:
+			ok++
+		case 503:
+			ko++
+		}
+	}
+
+	if ok != 25 || ko != 75 {
+		t.Errorf("every node of a cluster of 4 should accept a quarter of the capacity. ok: %d, ko: %d", ok, ko)
+	}
+	if hits != ok {
+		t.Errorf("hits do not match the tracked oks: %d/%d", hits, ok)
+	}
+}
+
+func TestNewRateLimiterMw_costHeader(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"max_rate":        0.001,
+				"capacity":        10,
+				"client_max_rate": 0.001,
+				"client_capacity": 20,
+				"strategy":        "ip",
+				"cost_header":     "X-Cost",
+			},
+		},
+	}
+
+	var hits int64
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt64(&hits, 1)
+		return &proxy.Response{
+			Data:       map[string]interface{}{"rows": 5},
+			IsComplete: true,
+			Metadata:   proxy.Metadata{Headers: map[string][]string{"X-Cost": {"5"}}},
+		}, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		req.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		statuses = append(statuses, w.Result().StatusCode)
+		if h := w.Result().Header.Get("X-Cost"); h != "" {
+			t.Errorf("the cost header should not be sent to the client: %s", h)
+		}
+	}
+
+	// every request costs 5 tokens, so the global limit is exhausted after 2 requests
+	if statuses[0] != 200 || statuses[1] != 200 || statuses[2] != 503 {
+		t.Errorf("unexpected statuses: %v", statuses)
+	}
+	if hits != 2 {
+		t.Errorf("unexpected number of hits: %d", hits)
+	}
+}
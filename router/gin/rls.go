@@ -0,0 +1,87 @@
+package gin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+	"github.com/krakend/krakend-ratelimit/v3/rls"
+	"github.com/krakend/krakend-ratelimit/v3/router"
+)
+
+// DescriptorsFn returns the descriptors of the rate limit service matching the request
+type DescriptorsFn func(*gin.Context) []rls.Descriptor
+
+// NewRLSLimiterMw returns a ratelimiting endpoint middleware asking the rate limit service if the
+// request matching the descriptors can be processed
+func NewRLSLimiterMw(client *rls.Client, descriptors DescriptorsFn) EndpointMw {
+	return func(next gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if !client.Allow(c.Request.Context(), descriptors(c), 1) {
+				c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
+				return
+			}
+			next(c)
+		}
+	}
+}
+
+// DescriptorsFnFromCfg returns the DescriptorsFn building the descriptors defined in the config
+// from the attributes of every request. The descriptors with an entry without value are skipped
+func DescriptorsFnFromCfg(cfg router.Config) (DescriptorsFn, error) {
+	type entry struct {
+		key   string
+		value TokenExtractor
+	}
+	descriptors := make([][]entry, 0, len(cfg.RLS.Descriptors))
+	for _, d := range cfg.RLS.Descriptors {
+		entries := make([]entry, 0, len(d))
+		for _, e := range d {
+			value, err := descriptorValueExtractor(e)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{key: e.Key, value: value})
+		}
+		descriptors = append(descriptors, entries)
+	}
+
+	return func(c *gin.Context) []rls.Descriptor {
+		res := make([]rls.Descriptor, 0, len(descriptors))
+	descriptorLoop:
+		for _, entries := range descriptors {
+			d := make(rls.Descriptor, 0, len(entries))
+			for _, e := range entries {
+				v := e.value(c)
+				if v == "" {
+					continue descriptorLoop
+				}
+				d = append(d, rls.Entry{Key: e.key, Value: v})
+			}
+			res = append(res, d)
+		}
+		return res
+	}, nil
+}
+
+func descriptorValueExtractor(e router.RLSDescriptorEntry) (TokenExtractor, error) {
+	switch e.Strategy {
+	case "":
+		value := e.Value
+		return func(*gin.Context) string { return value }, nil
+	case "ip":
+		return NewIPTokenExtractor(e.Name), nil
+	case "header":
+		return HeaderTokenExtractor(e.Name), nil
+	case "param":
+		return ParamTokenExtractor(e.Name), nil
+	case "method":
+		return func(c *gin.Context) string { return c.Request.Method }, nil
+	case "path":
+		return func(c *gin.Context) string { return c.Request.URL.Path }, nil
+	default:
+		return nil, fmt.Errorf("%w: descriptor strategy %q", ErrNotFound, e.Strategy)
+	}
+}
@@ -0,0 +1,218 @@
+package gin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"google.golang.org/grpc"
+
+	"github.com/krakend/krakend-ratelimit/v3/router"
+)
+
+func TestNewRateLimiterMw_rls(t *testing.T) {
+	srv := newFakeRLS(t, map[string]uint64{"user=alice": 2})
+	cfg := &config.EndpointConfig{
+		ExtraConfig: map[string]interface{}{
+			router.Namespace: map[string]interface{}{
+				"backend": "rls",
+				"rls": map[string]interface{}{
+					"address": srv.addr,
+					"domain":  "krakend",
+					"timeout": "1s",
+					"descriptors": []interface{}{
+						[]interface{}{
+							map[string]interface{}{"key": "user", "strategy": "header", "name": "X-User"},
+						},
+						[]interface{}{
+							map[string]interface{}{"key": "generic_key", "value": "api"},
+							map[string]interface{}{"key": "method", "strategy": "method"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{}, nil
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", HandlerFactory(cfg, p))
+
+	do := func(user string) int {
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := do("alice"); code != http.StatusOK {
+			t.Errorf("request #%d: unexpected status code %d", i, code)
+		}
+	}
+	if code := do("alice"); code != http.StatusTooManyRequests {
+		t.Errorf("unexpected status code %d", code)
+	}
+	if code := do("bob"); code != http.StatusOK {
+		t.Errorf("unexpected status code %d", code)
+	}
+
+	// the descriptors with missing values are not sent
+	if code := do(""); code != http.StatusOK {
+		t.Errorf("unexpected status code %d", code)
+	}
+	req := srv.lastRequest()
+	if req.GetDomain() != "krakend" || len(req.GetDescriptors()) != 1 {
+		t.Errorf("unexpected request: %v", req)
+		return
+	}
+	if entries := req.GetDescriptors()[0].GetEntries(); len(entries) != 2 || entries[1].GetValue() != "GET" {
+		t.Errorf("unexpected descriptor: %v", entries)
+	}
+}
+
+func TestNewRateLimiterMw_rlsFailure(t *testing.T) {
+	srv := newFakeRLS(t, nil)
+	srv.srv.Stop()
+
+	for _, failOpen := range []bool{false, true} {
+		cfg := &config.EndpointConfig{
+			ExtraConfig: map[string]interface{}{
+				router.Namespace: map[string]interface{}{
+					"backend": "rls",
+					"rls": map[string]interface{}{
+						"address":     srv.addr,
+						"domain":      "krakend",
+						"timeout":     "100ms",
+						"fail_open":   failOpen,
+						"descriptors": []interface{}{[]interface{}{map[string]interface{}{"key": "generic_key", "value": "api"}}},
+					},
+				},
+			},
+		}
+		p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{}, nil
+		}
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/", HandlerFactory(cfg, p))
+
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		want := http.StatusTooManyRequests
+		if failOpen {
+			want = http.StatusOK
+		}
+		if code := w.Result().StatusCode; code != want {
+			t.Errorf("fail open %v: unexpected status code %d", failOpen, code)
+		}
+	}
+}
+
+func TestNewRateLimiterMw_rlsSetupFailure(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		cfg := &config.EndpointConfig{
+			ExtraConfig: map[string]interface{}{
+				router.Namespace: map[string]interface{}{
+					"backend": "rls",
+					"rls": map[string]interface{}{
+						"address":     "127.0.0.1:8081",
+						"domain":      "krakend",
+						"ca_file":     "missing.pem",
+						"fail_open":   failOpen,
+						"descriptors": []interface{}{[]interface{}{map[string]interface{}{"key": "generic_key", "value": "api"}}},
+					},
+				},
+			},
+		}
+		p := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{}, nil
+		}
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/", HandlerFactory(cfg, p))
+
+		req, _ := http.NewRequest("GET", "/", http.NoBody)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		want := http.StatusTooManyRequests
+		if failOpen {
+			want = http.StatusOK
+		}
+		if code := w.Result().StatusCode; code != want {
+			t.Errorf("fail open %v: unexpected status code %d", failOpen, code)
+		}
+	}
+}
+
+// fakeRLS is an in-process rate limit service with a fixed amount of hits per descriptor,
+// identified by its entries joined as key=value pairs
+type fakeRLS struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	addr   string
+	srv    *grpc.Server
+	limits map[string]uint64
+	hits   map[string]uint64
+	last   *rlsv3.RateLimitRequest
+	mu     sync.Mutex
+}
+
+func newFakeRLS(t *testing.T, limits map[string]uint64) *fakeRLS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRLS{
+		addr:   l.Addr().String(),
+		srv:    grpc.NewServer(),
+		limits: limits,
+		hits:   map[string]uint64{},
+	}
+	rlsv3.RegisterRateLimitServiceServer(s.srv, s)
+	go s.srv.Serve(l)
+	t.Cleanup(s.srv.Stop)
+	return s
+}
+
+func (s *fakeRLS) lastRequest() *rlsv3.RateLimitRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *fakeRLS) ShouldRateLimit(_ context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = req
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for _, d := range req.GetDescriptors() {
+		entries := make([]string, 0, len(d.GetEntries()))
+		for _, e := range d.GetEntries() {
+			entries = append(entries, e.GetKey()+"="+e.GetValue())
+		}
+		key := strings.Join(entries, ",")
+		s.hits[key] += uint64(req.GetHitsAddend())
+		if limit, ok := s.limits[key]; ok && s.hits[key] > limit {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+	}
+	return resp, nil
+}
@@ -9,9 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+	"github.com/krakend/krakend-ratelimit/v3/memcached"
 	"github.com/luraproject/lura/v2/config"
 )
 
@@ -30,6 +32,162 @@ type Config struct {
 	NumShards      uint64        `json:"num_shards"`
 	CleanUpPeriod  time.Duration `json:"cleanup_period"`
 	CleanUpThreads uint64        `json:"cleanup_threads"`
+	MaxQueue       uint64        `json:"max_queue"`
+	ClientLimits   []ClientLimit `json:"client_limits"`
+	Period         string        `json:"period"`
+	// Quota is the number of requests of every client in a calendar period. It is the
+	// client_max_rate as declared, since the every param does not apply to the periods
+	Quota        uint64           `json:"-"`
+	Timezone     string           `json:"timezone"`
+	GlobalShards uint64           `json:"global_shards"`
+	WarmUp       time.Duration    `json:"warm_up"`
+	ColdRate     float64          `json:"cold_rate"`
+	Schedule     []ScheduleWindow `json:"schedule"`
+	CostHeader   string           `json:"cost_header"`
+	// Backend keeps the state of the client limiters: "redis", "memcached", "gossip" or "rls".
+	// Empty means the local memory
+	Backend   string          `json:"backend"`
+	Redis     RedisConfig     `json:"redis"`
+	Memcached MemcachedConfig `json:"memcached"`
+	Gossip    GossipConfig    `json:"gossip"`
+	Cluster   ClusterConfig   `json:"cluster"`
+	RLS       RLSConfig       `json:"rls"`
+}
+
+// RedisConfig defines the Redis server keeping the state of the client limiters when the
+// backend of the Config is "redis", so all the instances of a cluster share the same limits
+type RedisConfig struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// KeyPrefix is prepended to the keys of the limiters, followed by a hash of the limits, so only
+	// the endpoints with the same limits share the counters of a client
+	KeyPrefix string `json:"key_prefix"`
+	// Algorithm is either "token_bucket" (default) or "sliding_window"
+	Algorithm string `json:"algorithm"`
+	// Timeout is the maximum duration of every call to Redis
+	Timeout time.Duration `json:"timeout"`
+	// FailOpen allows the requests when Redis can not be reached
+	FailOpen bool `json:"fail_open"`
+	// LeaseSize is the amount of tokens leased at once by every instance, so most of the requests
+	// are served without calling Redis. Zero disables the leases. Only for the token bucket
+	LeaseSize uint64 `json:"lease_size"`
+	// LeaseTTL is the duration of the leases. The unused tokens are given back once it expires
+	LeaseTTL time.Duration `json:"lease_ttl"`
+	// Window is the size of the sliding window, taken from the every param
+	Window time.Duration `json:"-"`
+}
+
+// GossipConfig defines the node sharing the usage of the client limiters with its peers when the
+// backend of the Config is "gossip"
+type GossipConfig struct {
+	// Bind is the UDP address of the node. Several endpoints can share the same node
+	Bind string `json:"bind"`
+	// Peers are the UDP addresses of the rest of the nodes
+	Peers []string `json:"peers"`
+	// Interval is the time between two exchanges of usage with the peers
+	Interval time.Duration `json:"interval"`
+	// Name identifies the limits of the endpoint across the nodes. The endpoints sharing a name
+	// share their limits, so they must have the same ones. Defaults to a fingerprint of the client
+	// limits, so only the endpoints with the same limits share them
+	Name string `json:"name"`
+	// Secret is the key shared by all the nodes to sign their packets. Empty means unsigned packets
+	Secret string `json:"secret"`
+}
+
+// ClusterConfig defines how the node discovers the number of live instances of the cluster, so the
+// local limiters enforce their share of the rates and capacities. The size of the cluster comes
+// from the heartbeat files in HeartbeatDir if it is set, from the UDP heartbeats sent to the
+// peers if Bind is set, or from the static list of peers otherwise. Only the token buckets are
+// rescaled, so the cluster can not be combined with client_limits, period or schedule
+type ClusterConfig struct {
+	// Peers are the addresses of the rest of the nodes
+	Peers []string `json:"peers"`
+	// Bind is the UDP address where the node receives the heartbeats of its peers
+	Bind string `json:"bind"`
+	// HeartbeatDir is a directory shared by all the nodes where they keep their heartbeat files
+	HeartbeatDir string `json:"heartbeat_dir"`
+	// NodeID is the name of the heartbeat file of the node
+	NodeID string `json:"node_id"`
+	// Interval is the time between two heartbeats and two checks of the size of the cluster
+	Interval time.Duration `json:"interval"`
+	// TTL is the time after the last heartbeat of a node when it is considered dead
+	TTL time.Duration `json:"ttl"`
+}
+
+// Enabled flags if the limits are divided between the nodes of the cluster
+func (c ClusterConfig) Enabled() bool {
+	return len(c.Peers) > 0 || c.HeartbeatDir != ""
+}
+
+// RLSConfig defines the Envoy-compatible rate limit service deciding if the requests of the clients
+// are allowed when the backend of the Config is "rls"
+type RLSConfig struct {
+	// Address is the gRPC address of the service
+	Address string `json:"address"`
+	// Domain is the domain of the limits in the service. It is required
+	Domain string `json:"domain"`
+	// Timeout is the maximum duration of every call to the service
+	Timeout time.Duration `json:"timeout"`
+	// FailOpen allows the requests when the service can not be reached or its client can not be
+	// created
+	FailOpen bool `json:"fail_open"`
+	// TLS enables the TLS transport, verifying the service with the system roots or the CAFile.
+	// Otherwise, the transport is plaintext
+	TLS bool `json:"tls"`
+	// CAFile is the PEM file with the certificates of the authorities verifying the service. It
+	// enables the TLS transport
+	CAFile string `json:"ca_file"`
+	// Descriptors are the descriptors sent for every request, at least one of them. A descriptor is
+	// not sent if any of its entries has no value for the request
+	Descriptors [][]RLSDescriptorEntry `json:"descriptors"`
+}
+
+// RLSDescriptorEntry defines an entry of a descriptor. Its value is either the literal Value or the
+// attribute of the request selected by the Strategy: "ip", "header", "param", "method" or "path".
+// The header and param strategies use the attribute with the given Name, and the ip one uses it as
+// the header with the IP of the client, like the Key of the Config
+type RLSDescriptorEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Strategy string `json:"strategy"`
+	Name     string `json:"name"`
+}
+
+// MemcachedConfig defines the memcached servers keeping the state of the client limiters when
+// the backend of the Config is "memcached"
+type MemcachedConfig struct {
+	Servers []string `json:"servers"`
+	// KeyPrefix is prepended to the keys of the limiters, followed by a hash of the limits, so only
+	// the endpoints with the same limits share the counters of a client
+	KeyPrefix string `json:"key_prefix"`
+	// Algorithm is either "gcra" (default) or "fixed_window"
+	Algorithm string `json:"algorithm"`
+	// Timeout is the maximum duration of every call to memcached
+	Timeout time.Duration `json:"timeout"`
+	// FailOpen allows the requests when memcached can not be reached
+	FailOpen bool `json:"fail_open"`
+	// Window is the size of the fixed window, taken from the every param
+	Window time.Duration `json:"-"`
+}
+
+// ScheduleWindow overrides the ClientMaxRate and ClientCapacity of the Config during a daily
+// range of hours (HH:MM-HH:MM), optionally restricted to some days of the week (mon, tue... or
+// ranges like mon-fri). The hours are evaluated in the configured timezone.
+type ScheduleWindow struct {
+	Hours          string   `json:"hours"`
+	Days           []string `json:"days"`
+	ClientMaxRate  float64  `json:"client_max_rate"`
+	ClientCapacity uint64   `json:"client_capacity"`
+}
+
+// ClientLimit is an additional limit for every client, enforced together with the one defined by
+// the ClientMaxRate and ClientCapacity params. Its MaxRate is normalized to requests per second and,
+// if the capacity is not set, it defaults to the number of requests declared for its window,
+// so a limit of 500 requests every minute accepts bursts of up to 500 requests.
+type ClientLimit struct {
+	MaxRate  float64 `json:"max_rate"`
+	Capacity uint64  `json:"capacity"`
 }
 
 // ZeroCfg is the zero value for the Config struct
@@ -38,6 +196,9 @@ var ZeroCfg = Config{}
 var (
 	ErrNoExtraCfg    = errors.New("no extra config")
 	ErrWrongExtraCfg = errors.New("wrong extra config")
+	// ErrConflictingCfg is the error returned when the gossip node or the cluster membership of
+	// the config is already running with different settings for another endpoint
+	ErrConflictingCfg = errors.New("conflicting config")
 )
 
 // ConfigGetter parses the extra config for the rate adapter and
@@ -98,16 +259,35 @@ func ConfigGetter(e config.ExtraConfig) (Config, error) {
 	if v, ok := tmp["key"]; ok {
 		cfg.Key = fmt.Sprintf("%v", v)
 	}
+	if v, ok := tmp["cost_header"]; ok {
+		cfg.CostHeader = fmt.Sprintf("%v", v)
+	}
+	if v, ok := tmp["cold_rate"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.ColdRate = float64(val)
+		case int:
+			cfg.ColdRate = float64(val)
+		case float64:
+			cfg.ColdRate = val
+		}
+	}
 
+	// the calendar quotas use the client_max_rate as declared
+	quota := cfg.ClientMaxRate
 	cfg.TTL = krakendrate.DataTTL
+	factor := 1.0
+	window := time.Second
 	if v, ok := tmp["every"]; ok {
 		every, err := time.ParseDuration(fmt.Sprintf("%v", v))
-		if err != nil || every < time.Second {
+		if err != nil || every <= 0 {
 			every = time.Second
 		}
-		factor := float64(time.Second) / float64(every)
+		window = every
+		factor = float64(time.Second) / float64(every)
 		cfg.MaxRate = cfg.MaxRate * factor
 		cfg.ClientMaxRate = cfg.ClientMaxRate * factor
+		cfg.ColdRate = cfg.ColdRate * factor
 
 		if every > cfg.TTL {
 			// we do not need crypto strength random number to generate some
@@ -149,6 +329,478 @@ func ConfigGetter(e config.ExtraConfig) (Config, error) {
 			cfg.CleanUpThreads = uint64(val)
 		}
 	}
+	if v, ok := tmp["client_limits"]; ok {
+		limits, ok := v.([]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		for _, l := range limits {
+			limit, ok := l.(map[string]interface{})
+			if !ok {
+				return ZeroCfg, ErrWrongExtraCfg
+			}
+			cl := ClientLimit{}
+			if v, ok := limit["max_rate"]; ok {
+				switch val := v.(type) {
+				case int64:
+					cl.MaxRate = float64(val)
+				case int:
+					cl.MaxRate = float64(val)
+				case float64:
+					cl.MaxRate = val
+				}
+			}
+			if cl.MaxRate <= 0 {
+				return ZeroCfg, fmt.Errorf("%w: the client_limits require a positive max_rate", ErrWrongExtraCfg)
+			}
+			if v, ok := limit["capacity"]; ok {
+				switch val := v.(type) {
+				case int64:
+					cl.Capacity = uint64(val)
+				case int:
+					cl.Capacity = uint64(val)
+				case float64:
+					cl.Capacity = uint64(val)
+				}
+			}
+			if cl.Capacity == 0 {
+				if cl.MaxRate < 1 {
+					cl.Capacity = 1
+				} else {
+					cl.Capacity = uint64(cl.MaxRate)
+				}
+			}
+			if v, ok := limit["every"]; ok {
+				every, err := time.ParseDuration(fmt.Sprintf("%v", v))
+				if err != nil || every <= 0 {
+					every = time.Second
+				}
+				cl.MaxRate = cl.MaxRate * float64(time.Second) / float64(every)
+
+				if every > cfg.TTL {
+					cfg.TTL = time.Duration(int64((1 + 0.25*rand.Float64()) * float64(every))) // skipcq: GSC-G404
+				}
+			}
+			cfg.ClientLimits = append(cfg.ClientLimits, cl)
+		}
+	}
+	if v, ok := tmp["schedule"]; ok {
+		windows, ok := v.([]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		for _, w := range windows {
+			window, ok := w.(map[string]interface{})
+			if !ok {
+				return ZeroCfg, ErrWrongExtraCfg
+			}
+			sw := ScheduleWindow{}
+			if v, ok := window["hours"]; ok {
+				sw.Hours = fmt.Sprintf("%v", v)
+			}
+			if v, ok := window["days"]; ok {
+				days, ok := v.([]interface{})
+				if !ok {
+					return ZeroCfg, ErrWrongExtraCfg
+				}
+				for _, d := range days {
+					sw.Days = append(sw.Days, fmt.Sprintf("%v", d))
+				}
+			}
+			if _, err := krakendrate.ParseTimeWindow(sw.Hours, sw.Days); err != nil {
+				return ZeroCfg, fmt.Errorf("%w: %s", ErrWrongExtraCfg, err.Error())
+			}
+			if v, ok := window["client_max_rate"]; ok {
+				switch val := v.(type) {
+				case int64:
+					sw.ClientMaxRate = float64(val)
+				case int:
+					sw.ClientMaxRate = float64(val)
+				case float64:
+					sw.ClientMaxRate = val
+				}
+			}
+			if v, ok := window["client_capacity"]; ok {
+				switch val := v.(type) {
+				case int64:
+					sw.ClientCapacity = uint64(val)
+				case int:
+					sw.ClientCapacity = uint64(val)
+				case float64:
+					sw.ClientCapacity = uint64(val)
+				}
+			}
+			if sw.ClientMaxRate <= 0 {
+				return ZeroCfg, fmt.Errorf("%w: the schedule windows require a positive client_max_rate", ErrWrongExtraCfg)
+			}
+			if sw.ClientCapacity == 0 {
+				if sw.ClientMaxRate < 1 {
+					sw.ClientCapacity = 1
+				} else {
+					sw.ClientCapacity = uint64(sw.ClientMaxRate)
+				}
+			}
+			sw.ClientMaxRate = sw.ClientMaxRate * factor
+			cfg.Schedule = append(cfg.Schedule, sw)
+		}
+	}
+	if v, ok := tmp["period"]; ok {
+		cfg.Period = fmt.Sprintf("%v", v)
+		period, err := krakendrate.ParseCalendarPeriod(cfg.Period)
+		if err != nil {
+			return ZeroCfg, fmt.Errorf("%w: %s %q", ErrWrongExtraCfg, err.Error(), cfg.Period)
+		}
+		cfg.Quota = uint64(quota)
+		// the counters must not be evicted before the end of the period
+		if d := period.MaxDuration(); d > cfg.TTL {
+			cfg.TTL = time.Duration(int64((1 + 0.25*rand.Float64()) * float64(d))) // skipcq: GSC-G404
+		}
+	}
+	if v, ok := tmp["timezone"]; ok {
+		cfg.Timezone = fmt.Sprintf("%v", v)
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			return ZeroCfg, fmt.Errorf("%w: %s", ErrWrongExtraCfg, err.Error())
+		}
+	}
+	if v, ok := tmp["global_shards"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.GlobalShards = uint64(val)
+		case int:
+			cfg.GlobalShards = uint64(val)
+		case float64:
+			cfg.GlobalShards = uint64(val)
+		}
+	}
+	if v, ok := tmp["max_queue"]; ok {
+		switch val := v.(type) {
+		case int64:
+			cfg.MaxQueue = uint64(val)
+		case int:
+			cfg.MaxQueue = uint64(val)
+		case float64:
+			cfg.MaxQueue = uint64(val)
+		}
+	}
+	if v, ok := tmp["backend"]; ok {
+		cfg.Backend = fmt.Sprintf("%v", v)
+		switch cfg.Backend {
+		case "", "redis", "memcached", "gossip", "rls":
+		default:
+			return ZeroCfg, fmt.Errorf("%w: unknown backend %q", ErrWrongExtraCfg, cfg.Backend)
+		}
+	}
+	if v, ok := tmp["redis"]; ok {
+		rc, ok := v.(map[string]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		cfg.Redis = RedisConfig{
+			KeyPrefix: "krakend:ratelimit:",
+			Algorithm: "token_bucket",
+			Timeout:   100 * time.Millisecond,
+			LeaseTTL:  time.Second,
+			Window:    window,
+		}
+		if v, ok := rc["address"]; ok {
+			cfg.Redis.Address = fmt.Sprintf("%v", v)
+		}
+		if v, ok := rc["password"]; ok {
+			cfg.Redis.Password = fmt.Sprintf("%v", v)
+		}
+		if v, ok := rc["db"]; ok {
+			switch val := v.(type) {
+			case int64:
+				cfg.Redis.DB = int(val)
+			case int:
+				cfg.Redis.DB = val
+			case float64:
+				cfg.Redis.DB = int(val)
+			}
+		}
+		if v, ok := rc["key_prefix"]; ok {
+			cfg.Redis.KeyPrefix = fmt.Sprintf("%v", v)
+		}
+		if v, ok := rc["algorithm"]; ok {
+			cfg.Redis.Algorithm = fmt.Sprintf("%v", v)
+			if cfg.Redis.Algorithm != "token_bucket" && cfg.Redis.Algorithm != "sliding_window" {
+				return ZeroCfg, fmt.Errorf("%w: unknown redis algorithm %q", ErrWrongExtraCfg, cfg.Redis.Algorithm)
+			}
+		}
+		if v, ok := rc["timeout"]; ok {
+			d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong redis timeout: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.Redis.Timeout = d
+		}
+		if v, ok := rc["fail_open"]; ok {
+			if b, ok := v.(bool); ok {
+				cfg.Redis.FailOpen = b
+			}
+		}
+		if v, ok := rc["lease_size"]; ok {
+			switch val := v.(type) {
+			case int64:
+				cfg.Redis.LeaseSize = uint64(val)
+			case int:
+				cfg.Redis.LeaseSize = uint64(val)
+			case float64:
+				cfg.Redis.LeaseSize = uint64(val)
+			}
+		}
+		if v, ok := rc["lease_ttl"]; ok {
+			d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong redis lease_ttl: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.Redis.LeaseTTL = d
+		}
+	}
+	if v, ok := tmp["memcached"]; ok {
+		mc, ok := v.(map[string]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		cfg.Memcached = MemcachedConfig{
+			KeyPrefix: "krakend:ratelimit:",
+			Algorithm: "gcra",
+			Timeout:   100 * time.Millisecond,
+			Window:    window,
+		}
+		if v, ok := mc["servers"]; ok {
+			servers, _ := v.([]interface{})
+			for _, s := range servers {
+				cfg.Memcached.Servers = append(cfg.Memcached.Servers, fmt.Sprintf("%v", s))
+			}
+		}
+		if v, ok := mc["key_prefix"]; ok {
+			cfg.Memcached.KeyPrefix = fmt.Sprintf("%v", v)
+		}
+		if v, ok := mc["algorithm"]; ok {
+			cfg.Memcached.Algorithm = fmt.Sprintf("%v", v)
+			if cfg.Memcached.Algorithm != "gcra" && cfg.Memcached.Algorithm != "fixed_window" {
+				return ZeroCfg, fmt.Errorf("%w: unknown memcached algorithm %q", ErrWrongExtraCfg, cfg.Memcached.Algorithm)
+			}
+		}
+		if v, ok := mc["timeout"]; ok {
+			d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong memcached timeout: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.Memcached.Timeout = d
+		}
+		if v, ok := mc["fail_open"]; ok {
+			if b, ok := v.(bool); ok {
+				cfg.Memcached.FailOpen = b
+			}
+		}
+	}
+	if v, ok := tmp["gossip"]; ok {
+		gc, ok := v.(map[string]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		cfg.Gossip = GossipConfig{
+			Interval: 100 * time.Millisecond,
+		}
+		if v, ok := gc["bind"]; ok {
+			cfg.Gossip.Bind = fmt.Sprintf("%v", v)
+		}
+		if v, ok := gc["peers"]; ok {
+			peers, _ := v.([]interface{})
+			for _, p := range peers {
+				cfg.Gossip.Peers = append(cfg.Gossip.Peers, fmt.Sprintf("%v", p))
+			}
+		}
+		if v, ok := gc["interval"]; ok {
+			d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil || d <= 0 {
+				return ZeroCfg, fmt.Errorf("%w: wrong gossip interval %q", ErrWrongExtraCfg, fmt.Sprintf("%v", v))
+			}
+			cfg.Gossip.Interval = d
+		}
+		if v, ok := gc["name"]; ok {
+			cfg.Gossip.Name = fmt.Sprintf("%v", v)
+		}
+		if v, ok := gc["secret"]; ok {
+			cfg.Gossip.Secret = fmt.Sprintf("%v", v)
+		}
+	}
+	if v, ok := tmp["cluster"]; ok {
+		cc, ok := v.(map[string]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		if v, ok := cc["peers"]; ok {
+			peers, _ := v.([]interface{})
+			for _, p := range peers {
+				cfg.Cluster.Peers = append(cfg.Cluster.Peers, fmt.Sprintf("%v", p))
+			}
+		}
+		if v, ok := cc["bind"]; ok {
+			cfg.Cluster.Bind = fmt.Sprintf("%v", v)
+		}
+		if v, ok := cc["heartbeat_dir"]; ok {
+			cfg.Cluster.HeartbeatDir = fmt.Sprintf("%v", v)
+		}
+		if v, ok := cc["node_id"]; ok {
+			cfg.Cluster.NodeID = fmt.Sprintf("%v", v)
+		}
+		if v, ok := cc["interval"]; ok {
+			interval, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong cluster interval: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.Cluster.Interval = interval
+		}
+		if v, ok := cc["ttl"]; ok {
+			ttl, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong cluster ttl: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.Cluster.TTL = ttl
+		}
+	}
+	if v, ok := tmp["rls"]; ok {
+		rc, ok := v.(map[string]interface{})
+		if !ok {
+			return ZeroCfg, ErrWrongExtraCfg
+		}
+		cfg.RLS = RLSConfig{Timeout: 100 * time.Millisecond}
+		if v, ok := rc["address"]; ok {
+			cfg.RLS.Address = fmt.Sprintf("%v", v)
+		}
+		if v, ok := rc["domain"]; ok {
+			cfg.RLS.Domain = fmt.Sprintf("%v", v)
+		}
+		if v, ok := rc["timeout"]; ok {
+			d, err := time.ParseDuration(fmt.Sprintf("%v", v))
+			if err != nil {
+				return ZeroCfg, fmt.Errorf("%w: wrong rls timeout: %s", ErrWrongExtraCfg, err.Error())
+			}
+			cfg.RLS.Timeout = d
+		}
+		if v, ok := rc["fail_open"]; ok {
+			if b, ok := v.(bool); ok {
+				cfg.RLS.FailOpen = b
+			}
+		}
+		if v, ok := rc["tls"]; ok {
+			if b, ok := v.(bool); ok {
+				cfg.RLS.TLS = b
+			}
+		}
+		if v, ok := rc["ca_file"]; ok {
+			cfg.RLS.CAFile = fmt.Sprintf("%v", v)
+			cfg.RLS.TLS = true
+		}
+		if v, ok := rc["descriptors"]; ok {
+			descriptors, _ := v.([]interface{})
+			for _, d := range descriptors {
+				entries, ok := d.([]interface{})
+				if !ok || len(entries) == 0 {
+					return ZeroCfg, fmt.Errorf("%w: wrong rls descriptor", ErrWrongExtraCfg)
+				}
+				descriptor := make([]RLSDescriptorEntry, 0, len(entries))
+				for _, e := range entries {
+					entry, ok := e.(map[string]interface{})
+					if !ok {
+						return ZeroCfg, fmt.Errorf("%w: wrong rls descriptor entry", ErrWrongExtraCfg)
+					}
+					de := RLSDescriptorEntry{}
+					if v, ok := entry["key"]; ok {
+						de.Key = fmt.Sprintf("%v", v)
+					}
+					if v, ok := entry["value"]; ok {
+						de.Value = fmt.Sprintf("%v", v)
+					}
+					if v, ok := entry["strategy"]; ok {
+						de.Strategy = strings.ToLower(fmt.Sprintf("%v", v))
+					}
+					if v, ok := entry["name"]; ok {
+						de.Name = fmt.Sprintf("%v", v)
+					}
+					if de.Key == "" {
+						return ZeroCfg, fmt.Errorf("%w: rls descriptor entry without key", ErrWrongExtraCfg)
+					}
+					switch de.Strategy {
+					case "", "ip", "header", "param", "method", "path":
+					default:
+						return ZeroCfg, fmt.Errorf("%w: unknown rls descriptor strategy %q", ErrWrongExtraCfg, de.Strategy)
+					}
+					if de.Strategy == "" && de.Value == "" {
+						return ZeroCfg, fmt.Errorf("%w: rls descriptor entry %q without value", ErrWrongExtraCfg, de.Key)
+					}
+					descriptor = append(descriptor, de)
+				}
+				cfg.RLS.Descriptors = append(cfg.RLS.Descriptors, descriptor)
+			}
+		}
+	}
+	if cfg.Backend == "rls" && cfg.RLS.Address == "" {
+		return ZeroCfg, fmt.Errorf("%w: the rls backend requires an address", ErrWrongExtraCfg)
+	}
+	if cfg.Backend == "rls" && (cfg.RLS.Domain == "" || len(cfg.RLS.Descriptors) == 0) {
+		return ZeroCfg, fmt.Errorf("%w: the rls backend requires a domain and at least a descriptor", ErrWrongExtraCfg)
+	}
+	if cfg.Backend == "gossip" && cfg.Gossip.Bind == "" {
+		return ZeroCfg, fmt.Errorf("%w: the gossip backend requires a bind address", ErrWrongExtraCfg)
+	}
+	if cfg.Backend == "memcached" && len(cfg.Memcached.Servers) == 0 {
+		return ZeroCfg, fmt.Errorf("%w: the memcached backend requires at least a server", ErrWrongExtraCfg)
+	}
+	if cfg.Backend == "memcached" {
+		// the state of the limiters can not outlive the longest expiration of memcached
+		lifetime := cfg.Memcached.Window.Seconds()
+		if cfg.Memcached.Algorithm == "gcra" && cfg.ClientMaxRate > 0 {
+			lifetime = float64(max(cfg.ClientCapacity, 1)+1) / cfg.ClientMaxRate
+		}
+		if lifetime > memcached.MaxExpiration.Seconds() {
+			return ZeroCfg, fmt.Errorf("%w: the memcached limiters can not keep their state longer than %s",
+				ErrWrongExtraCfg, memcached.MaxExpiration)
+		}
+	}
+	if cfg.Backend == "redis" && cfg.Redis.Address == "" {
+		return ZeroCfg, fmt.Errorf("%w: the redis backend requires an address", ErrWrongExtraCfg)
+	}
+	if (cfg.Backend == "redis" || cfg.Backend == "memcached") && hasLocalClientOptions(cfg) {
+		return ZeroCfg, fmt.Errorf("%w: the %s backend does not support client_limits, period, schedule or cost_header",
+			ErrWrongExtraCfg, cfg.Backend)
+	}
+	if v, ok := tmp["warm_up"]; ok {
+		warmUp, err := time.ParseDuration(fmt.Sprintf("%v", v))
+		if err != nil {
+			return ZeroCfg, fmt.Errorf("%w: %s", ErrWrongExtraCfg, err.Error())
+		}
+		cfg.WarmUp = warmUp
+		// by default, the global limit starts at a third of its max rate
+		if cfg.ColdRate <= 0 {
+			cfg.ColdRate = cfg.MaxRate / 3
+		}
+	}
+	if cfg.Period != "" && len(cfg.Schedule) > 0 {
+		return ZeroCfg, fmt.Errorf("%w: the calendar quotas can not be scheduled", ErrWrongExtraCfg)
+	}
+	if cfg.MaxQueue > 0 && (cfg.WarmUp > 0 || cfg.GlobalShards > 1) {
+		return ZeroCfg, fmt.Errorf("%w: max_queue can not be combined with warm_up or global_shards", ErrWrongExtraCfg)
+	}
+	if cfg.WarmUp > 0 && cfg.GlobalShards > 1 {
+		return ZeroCfg, fmt.Errorf("%w: warm_up can not be combined with global_shards", ErrWrongExtraCfg)
+	}
+	if cfg.Cluster.Enabled() && (cfg.MaxQueue > 0 || cfg.GlobalShards > 1) {
+		return ZeroCfg, fmt.Errorf("%w: cluster can not be combined with max_queue or global_shards", ErrWrongExtraCfg)
+	}
+	// only the token buckets can be rescaled to the size of the cluster
+	if cfg.Cluster.Enabled() && (len(cfg.ClientLimits) > 0 || cfg.Period != "" || len(cfg.Schedule) > 0) {
+		return ZeroCfg, fmt.Errorf("%w: cluster can not be combined with client_limits, period or schedule", ErrWrongExtraCfg)
+	}
 
 	return cfg, nil
 }
+
+// hasLocalClientOptions flags if the config uses options of the client limits only supported by
+// the limiters kept in memory
+func hasLocalClientOptions(cfg Config) bool {
+	return len(cfg.ClientLimits) > 0 || cfg.Period != "" || len(cfg.Schedule) > 0 || cfg.CostHeader != ""
+}
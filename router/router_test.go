@@ -2,8 +2,17 @@ package router
 
 import (
 	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+	"github.com/krakend/krakend-ratelimit/v3/gossip"
+	"github.com/krakend/krakend-ratelimit/v3/memcached"
 	"github.com/luraproject/lura/v2/config"
 )
 
@@ -12,7 +21,8 @@ func TestConfigGetter(t *testing.T) {
 		"qos/ratelimit/router": {
 			"max_rate":10,
 			"capacity":10,
-			"every": "2s"
+			"every": "2s",
+			"max_queue": 5
 		}
 	}`)
 	var dat config.ExtraConfig
@@ -38,7 +48,896 @@ func TestConfigGetter(t *testing.T) {
 	if cfg.Key != "" {
 		t.Errorf("wrong value for Key. Want: '', have: %s", cfg.Key)
 	}
+	if cfg.MaxQueue != 5 {
+		t.Errorf("wrong value for MaxQueue. Want: 5, have: %d", cfg.MaxQueue)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigGetter_subSecondWindow(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"max_rate": 3,
+			"client_max_rate": 1,
+			"every": "100ms"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+	}
+	if cfg.MaxRate != 30 {
+		t.Errorf("wrong value for MaxRate. Want: 30, have: %f", cfg.MaxRate)
+	}
+	if cfg.ClientMaxRate != 10 {
+		t.Errorf("wrong value for ClientMaxRate. Want: 10, have: %f", cfg.ClientMaxRate)
+	}
+}
+
+func TestConfigGetter_warmUp(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"max_rate": 120,
+			"every": "1m",
+			"warm_up": "5m"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+	}
+	if cfg.WarmUp != 5*time.Minute {
+		t.Errorf("wrong value for WarmUp. Want: 5m, have: %s", cfg.WarmUp)
+	}
+	if cfg.ColdRate != 2.0/3 {
+		t.Errorf("wrong value for ColdRate. Want: 0.666, have: %f", cfg.ColdRate)
+	}
+
+	dat[Namespace].(map[string]interface{})["cold_rate"] = 60
+	if cfg, _ = ConfigGetter(dat); cfg.ColdRate != 1 {
+		t.Errorf("wrong value for ColdRate. Want: 1, have: %f", cfg.ColdRate)
+	}
+
+	dat[Namespace].(map[string]interface{})["warm_up"] = "soon"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigGetter_globalLimitConflicts(t *testing.T) {
+	for _, c := range []string{
+		`{"qos/ratelimit/router": {"max_rate": 10, "max_queue": 10, "warm_up": "1m"}}`,
+		`{"qos/ratelimit/router": {"max_rate": 10, "max_queue": 10, "global_shards": 4}}`,
+		`{"qos/ratelimit/router": {"max_rate": 10, "warm_up": "1m", "global_shards": 4}}`,
+		`{"qos/ratelimit/router": {"max_rate": 10, "max_queue": 10, "cluster": {"peers": ["10.0.0.2:7946"]}}}`,
+		`{"qos/ratelimit/router": {"max_rate": 10, "global_shards": 4, "cluster": {"peers": ["10.0.0.2:7946"]}}}`,
+	} {
+		var dat config.ExtraConfig
+		if err := json.Unmarshal([]byte(c), &dat); err != nil {
+			t.Error(err.Error())
+		}
+		if _, err := ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %s: %v", c, err)
+		}
+	}
+}
+
+func TestConfigGetter_schedule(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 60,
+			"every": "1m",
+			"schedule": [
+				{"hours": "09:00-18:00", "days": ["mon-fri"], "client_max_rate": 30},
+				{"hours": "22:00-06:00", "client_max_rate": 600, "client_capacity": 100}
+			]
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []ScheduleWindow{
+		{Hours: "09:00-18:00", Days: []string{"mon-fri"}, ClientMaxRate: 0.5, ClientCapacity: 30},
+		{Hours: "22:00-06:00", ClientMaxRate: 10, ClientCapacity: 100},
+	}
+	if len(cfg.Schedule) != len(want) {
+		t.Errorf("unexpected schedule: %+v", cfg.Schedule)
+		return
+	}
+	for i, w := range want {
+		sw := cfg.Schedule[i]
+		if sw.Hours != w.Hours || len(sw.Days) != len(w.Days) || sw.ClientMaxRate != w.ClientMaxRate ||
+			sw.ClientCapacity != w.ClientCapacity {
+			t.Errorf("unexpected window #%d: %+v", i, sw)
+		}
+	}
+	if _, ok := limiterBuilderFromCfg(cfg)().(*krakendrate.ScheduledLimiter); !ok {
+		t.Error("the client limiters should be scheduled")
+	}
+
+	for _, schedule := range []interface{}{
+		[]interface{}{map[string]interface{}{"hours": "9am-6pm", "client_max_rate": 30}},
+		[]interface{}{map[string]interface{}{"hours": "09:00-18:00", "days": "mon-fri"}},
+		map[string]interface{}{"hours": "09:00-18:00", "client_max_rate": 30},
+		[]interface{}{map[string]interface{}{"hours": "09:00-18:00"}},
+		[]interface{}{map[string]interface{}{"hours": "09:00-18:00", "client_max_rate": 0}},
+		[]interface{}{map[string]interface{}{"hours": "24:00-06:00", "client_max_rate": 30}},
+	} {
+		dat[Namespace].(map[string]interface{})["schedule"] = schedule
+		if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %v: %v", schedule, err)
+		}
+	}
+
+	dat[Namespace].(map[string]interface{})["schedule"] = []interface{}{
+		map[string]interface{}{"hours": "09:00-18:00", "client_max_rate": 30},
+	}
+	dat[Namespace].(map[string]interface{})["period"] = "day"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the calendar quotas should not be scheduled: %v", err)
+	}
+}
+
+func TestConfigGetter_clientLimits(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 10,
+			"client_capacity": 10,
+			"strategy": "ip",
+			"client_limits": [
+				{"max_rate": 3, "every": "1m"},
+				{"max_rate": 10000, "capacity": 100, "every": "24h"}
+			]
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(cfg.ClientLimits) != 2 {
+		t.Errorf("unexpected client limits: %+v", cfg.ClientLimits)
+		return
+	}
+	if l := cfg.ClientLimits[0]; l.MaxRate != 3.0/60 || l.Capacity != 3 {
+		t.Errorf("unexpected client limit: %+v", l)
+	}
+	if l := cfg.ClientLimits[1]; l.MaxRate != 10000.0/86400 || l.Capacity != 100 {
+		t.Errorf("unexpected client limit: %+v", l)
+	}
+	if cfg.TTL < 24*time.Hour {
+		t.Errorf("the TTL should cover the longest window: %s", cfg.TTL)
+	}
+
+	store := StoreFromCfg(cfg)
+	for i := 0; i < 3; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the 4th request should be rejected by the per minute limit")
+	}
+
+	for _, limits := range []interface{}{
+		map[string]interface{}{"max_rate": 3},
+		[]interface{}{map[string]interface{}{"every": "1m"}},
+		[]interface{}{map[string]interface{}{"max_rate": 0, "every": "1m"}},
+	} {
+		dat[Namespace].(map[string]interface{})["client_limits"] = limits
+		if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %v: %v", limits, err)
+		}
+	}
+}
+
+func TestConfigGetter_calendarQuota(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 2,
+			"strategy": "header",
+			"key": "X-Api-Key",
+			"period": "month",
+			"timezone": "Europe/Madrid"
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.Period != "month" || cfg.Timezone != "Europe/Madrid" {
+		t.Errorf("unexpected calendar config: %s %s", cfg.Period, cfg.Timezone)
+	}
+	if cfg.TTL < 31*24*time.Hour {
+		t.Errorf("the TTL should cover the whole period: %s", cfg.TTL)
+	}
+
+	store := StoreFromCfg(cfg)
+	for i := 0; i < 2; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the 3rd request should be rejected by the monthly quota")
+	}
+
+	// the quota is not scaled by the every param
+	serializedCfg = []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 1000,
+			"every": "1h",
+			"strategy": "ip",
+			"period": "month"
+		}
+	}`)
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err = ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.Quota != 1000 {
+		t.Errorf("unexpected quota: %d", cfg.Quota)
+	}
+	store = StoreFromCfg(cfg)
+	for i := 0; i < 1000; i++ {
+		if !store("a").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+			break
+		}
+	}
+	if store("a").Allow() {
+		t.Error("the request #1001 should be rejected by the monthly quota")
+	}
+
+	for _, c := range []string{
+		`{"qos/ratelimit/router": {"period": "fortnight"}}`,
+		`{"qos/ratelimit/router": {"period": "day", "timezone": "Mars/Olympus_Mons"}}`,
+	} {
+		if err := json.Unmarshal([]byte(c), &dat); err != nil {
+			t.Error(err.Error())
+		}
+		if _, err := ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %s: %v", c, err)
+		}
+	}
+}
+
+func TestConfigGetter_redis(t *testing.T) {
+	s := miniredis.RunT(t)
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 2,
+			"client_capacity": 2,
+			"every": "1m",
+			"backend": "redis",
+			"redis": {
+				"address": "` + s.Addr() + `",
+				"algorithm": "sliding_window",
+				"timeout": "1s"
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.Backend != "redis" || cfg.Redis.Algorithm != "sliding_window" || cfg.Redis.Window != time.Minute ||
+		cfg.Redis.Timeout != time.Second || cfg.Redis.KeyPrefix != "krakend:ratelimit:" {
+		t.Errorf("unexpected redis config: %+v", cfg.Redis)
+	}
+
+	// two replicas sharing the same server share the same limits
+	a, b := StoreFromCfg(cfg), StoreFromCfg(cfg)
+	if !a("client").Allow() || !b("client").Allow() {
+		t.Error("the first requests should be allowed")
+	}
+	if a("client").Allow() || b("client").Allow() {
+		t.Error("the limit should be shared by both stores")
+	}
+	if !a("other").Allow() {
+		t.Error("the limits are per client")
+	}
+
+	dat[Namespace].(map[string]interface{})["period"] = "day"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the redis backend should not accept calendar quotas: %v", err)
+	}
+	delete(dat[Namespace].(map[string]interface{}), "period")
+
+	delete(dat[Namespace].(map[string]interface{})["redis"].(map[string]interface{}), "address")
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigGetter_unknownBackend(t *testing.T) {
+	_, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+		"client_max_rate": 10,
+		"backend":         "redsi",
+	}})
+	if !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigGetter_wrongDurations(t *testing.T) {
+	for _, c := range []string{
+		`{"qos/ratelimit/router": {"backend": "redis", "redis": {"address": "127.0.0.1:6379", "timeout": "100"}}}`,
+		`{"qos/ratelimit/router": {"backend": "redis", "redis": {"address": "127.0.0.1:6379", "lease_ttl": "1 second"}}}`,
+		`{"qos/ratelimit/router": {"backend": "memcached", "memcached": {"servers": ["127.0.0.1:11211"], "timeout": "fast"}}}`,
+		`{"qos/ratelimit/router": {"backend": "gossip", "gossip": {"bind": "127.0.0.1:7946", "interval": "-1s"}}}`,
+		`{"qos/ratelimit/router": {"backend": "rls", "rls": {"address": "127.0.0.1:8081", "timeout": "100"}}}`,
+	} {
+		var dat config.ExtraConfig
+		if err := json.Unmarshal([]byte(c), &dat); err != nil {
+			t.Error(err.Error())
+		}
+		if _, err := ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %s: %v", c, err)
+		}
+	}
+}
+
+func TestStoreFromCfg_redisScopedByLimits(t *testing.T) {
+	s := miniredis.RunT(t)
+	cfg := Config{
+		ClientMaxRate:  1e-6,
+		ClientCapacity: 1,
+		Backend:        "redis",
+		Redis: RedisConfig{
+			Address:   s.Addr(),
+			KeyPrefix: "rl:",
+			Algorithm: "token_bucket",
+			Timeout:   time.Second,
+		},
+	}
+	small := StoreFromCfg(cfg)
+	cfg.ClientCapacity = 100
+	big := StoreFromCfg(cfg)
+
+	if !small("client").Allow() {
+		t.Error("the first request should be allowed")
+	}
+	if small("client").Allow() {
+		t.Error("the small bucket should be exhausted")
+	}
+	for i := 0; i < 100; i++ {
+		if !big("client").Allow() {
+			t.Errorf("request #%d should be allowed by the bucket of the bigger limit", i)
+			return
+		}
+	}
+	if keys := s.Keys(); len(keys) != 2 {
+		t.Errorf("every limit should have its own key: %v", keys)
+	}
+}
+
+func TestConfigGetter_redisLease(t *testing.T) {
+	s := miniredis.RunT(t)
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 1,
+			"client_capacity": 10,
+			"backend": "redis",
+			"redis": {
+				"address": "` + s.Addr() + `",
+				"lease_size": 4,
+				"lease_ttl": "1m"
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.Redis.LeaseSize != 4 || cfg.Redis.LeaseTTL != time.Minute {
+		t.Errorf("unexpected redis config: %+v", cfg.Redis)
+	}
+
+	store := StoreFromCfg(cfg)
+	if _, ok := store("client").(*krakendrate.LeasedLimiter); !ok {
+		t.Error("the limiters should lease their tokens")
+	}
+	for i := 0; i < 10; i++ {
+		if !store("client").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if store("client").Allow() {
+		t.Error("the shared bucket should be exhausted")
+	}
+}
+
+func TestConfigGetter_gossip(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = conn.LocalAddr().String()
+		conn.Close()
+	}
+
+	stores := make([]krakendrate.LimiterStore, 2)
+	for i := range stores {
+		serializedCfg := []byte(`{
+			"qos/ratelimit/router": {
+				"client_max_rate": 10,
+				"client_capacity": 10,
+				"every": "1h",
+				"backend": "gossip",
+				"gossip": {
+					"bind": "` + addrs[i] + `",
+					"peers": ["` + addrs[1-i] + `"],
+					"interval": "10ms",
+					"name": "users"
+				}
+			}
+		}`)
+		var dat config.ExtraConfig
+		if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+			t.Error(err.Error())
+		}
+		cfg, err := ConfigGetter(dat)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if cfg.Gossip.Bind != addrs[i] || len(cfg.Gossip.Peers) != 1 || cfg.Gossip.Interval != 10*time.Millisecond ||
+			cfg.Gossip.Name != "users" {
+			t.Errorf("unexpected gossip config: %+v", cfg.Gossip)
+		}
+		stores[i] = StoreFromCfg(cfg)
+	}
+
+	for i := 0; i < 7; i++ {
+		if !stores[0]("client").Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if stores[1]("client").(krakendrate.StatefulLimiter).State().Remaining == 3 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if !stores[1]("client").Allow() {
+			t.Errorf("request #%d to the peer should be allowed", i)
+		}
+	}
+	if stores[1]("client").Allow() {
+		t.Error("the peer should account the usage of the first node")
+	}
+
+	var dat config.ExtraConfig
+	if err := json.Unmarshal([]byte(`{"qos/ratelimit/router": {"backend": "gossip", "gossip": {}}}`), &dat); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewStoreFromCfg_gossipNames(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	cfgFor := func(rate int, name string) Config {
+		gossipCfg := map[string]interface{}{"bind": addr}
+		if name != "" {
+			gossipCfg["name"] = name
+		}
+		cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+			"client_max_rate": rate,
+			"client_capacity": rate,
+			"every":           "1h",
+			"backend":         "gossip",
+			"gossip":          gossipCfg,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	small, err := NewStoreFromCfg(cfgFor(5, ""))
 	if err != nil {
+		t.Fatal(err)
+	}
+	big, err := NewStoreFromCfg(cfgFor(10, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small("client").Allow()
+	if st := big("client").(krakendrate.StatefulLimiter).State(); st.Remaining != 10 {
+		t.Errorf("the endpoints with different limits should not share the default name. remaining: %d", st.Remaining)
+	}
+
+	if _, err := NewStoreFromCfg(cfgFor(5, "users")); err != nil {
 		t.Error(err)
 	}
+	if _, err := NewStoreFromCfg(cfgFor(10, "users")); !errors.Is(err, gossip.ErrStoreConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewStoreFromCfg_gossipNodeConflict(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	cfgFor := func(gossipCfg map[string]interface{}) Config {
+		gossipCfg["bind"] = addr
+		cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+			"client_max_rate": 10,
+			"client_capacity": 10,
+			"backend":         "gossip",
+			"gossip":          gossipCfg,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	if _, err := NewStoreFromCfg(cfgFor(map[string]interface{}{"peers": []interface{}{"127.0.0.1:7946"}})); err != nil {
+		t.Fatal(err)
+	}
+	for i, gc := range []map[string]interface{}{
+		{"peers": []interface{}{"127.0.0.1:7947"}},
+		{"peers": []interface{}{"127.0.0.1:7946"}, "secret": "s3cr3t"},
+		{"peers": []interface{}{"127.0.0.1:7946"}, "interval": "1s"},
+	} {
+		if _, err := NewStoreFromCfg(cfgFor(gc)); !errors.Is(err, ErrConflictingCfg) {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+	cfg := cfgFor(map[string]interface{}{"peers": []interface{}{"127.0.0.1:7946"}})
+	cfg.NumShards = 4
+	if _, err := NewStoreFromCfg(cfg); !errors.Is(err, ErrConflictingCfg) {
+		t.Errorf("unexpected error with other shards: %v", err)
+	}
+}
+
+func TestDividerFromCfg_conflict(t *testing.T) {
+	dir := t.TempDir()
+	cfgFor := func(clusterCfg map[string]interface{}) Config {
+		clusterCfg["heartbeat_dir"] = dir
+		cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+			"client_max_rate": 10,
+			"client_capacity": 10,
+			"cluster":         clusterCfg,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	d, err := DividerFromCfg(cfgFor(map[string]interface{}{"node_id": "node-a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := DividerFromCfg(cfgFor(map[string]interface{}{"node_id": "node-a"})); err != nil || other != d {
+		t.Errorf("the same membership should be reused: %v", err)
+	}
+	for i, cc := range []map[string]interface{}{
+		{"node_id": "node-b"},
+		{"node_id": "node-a", "interval": "10ms"},
+		{"node_id": "node-a", "ttl": "1m"},
+	} {
+		if _, err := DividerFromCfg(cfgFor(cc)); !errors.Is(err, ErrConflictingCfg) {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestConfigGetter_clusterWithLocalOptions(t *testing.T) {
+	for name, opts := range map[string]map[string]interface{}{
+		"client_limits": {"client_limits": []interface{}{map[string]interface{}{"max_rate": 3, "every": "1m"}}},
+		"period":        {"period": "month"},
+		"schedule": {"schedule": []interface{}{
+			map[string]interface{}{"hours": "09:00-18:00", "client_max_rate": 30},
+		}},
+	} {
+		extra := map[string]interface{}{
+			"client_max_rate": 10,
+			"client_capacity": 10,
+			"cluster":         map[string]interface{}{"peers": []interface{}{"127.0.0.1:7946"}},
+		}
+		for k, v := range opts {
+			extra[k] = v
+		}
+		if _, err := ConfigGetter(config.ExtraConfig{Namespace: extra}); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("%s: the cluster should not accept the limiters that can not be rescaled: %v", name, err)
+		}
+		delete(extra, "cluster")
+		if _, err := ConfigGetter(config.ExtraConfig{Namespace: extra}); err != nil {
+			t.Errorf("%s: unexpected error without cluster: %v", name, err)
+		}
+	}
+}
+
+func TestConfigGetter_cluster(t *testing.T) {
+	dir := t.TempDir()
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 1,
+			"client_capacity": 10,
+			"every": "1h",
+			"cluster": {
+				"heartbeat_dir": "` + dir + `",
+				"node_id": "node-a",
+				"interval": "10ms",
+				"ttl": "1m"
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !cfg.Cluster.Enabled() || cfg.Cluster.HeartbeatDir != dir || cfg.Cluster.NodeID != "node-a" ||
+		cfg.Cluster.Interval != 10*time.Millisecond || cfg.Cluster.TTL != time.Minute {
+		t.Errorf("unexpected cluster config: %+v", cfg.Cluster)
+	}
+
+	// another node of the cluster
+	if err := os.WriteFile(filepath.Join(dir, "node-b.hb"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := StoreFromCfg(cfg)
+	if d, err := DividerFromCfg(cfg); err != nil || d == nil {
+		t.Errorf("the limits should be divided: %v", err)
+	} else {
+		d.Refresh()
+	}
+	if st := store("client").(krakendrate.StatefulLimiter).State(); st.Limit != 5 {
+		t.Errorf("the client limiters should be rescaled: %+v", st)
+	}
+
+	dat[Namespace].(map[string]interface{})["cluster"] = map[string]interface{}{"ttl": "3 seconds"}
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewStoreFromCfg_clusterError(t *testing.T) {
+	cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+		"client_max_rate": 10,
+		"client_capacity": 10,
+		"cluster": map[string]interface{}{
+			"bind":  "not an address",
+			"peers": []interface{}{"127.0.0.1:7946"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DividerFromCfg(cfg); err == nil {
+		t.Error("the divider should fail when the membership can not be started")
+	}
+	if _, err := NewStoreFromCfg(cfg); err == nil {
+		t.Error("the store should fail when the membership can not be started")
+	}
+	if !StoreFromCfg(cfg)("client").Allow() {
+		t.Error("the limits should be enforced locally")
+	}
+}
+
+func TestConfigGetter_rls(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"backend": "rls",
+			"rls": {
+				"address": "127.0.0.1:8081",
+				"domain": "krakend",
+				"fail_open": true,
+				"descriptors": [
+					[{"key": "remote_address", "strategy": "IP", "name": "X-Forwarded-For"}],
+					[{"key": "generic_key", "value": "api"}, {"key": "user", "strategy": "header", "name": "X-User"}]
+				]
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rc := cfg.RLS
+	if cfg.Backend != "rls" || rc.Address != "127.0.0.1:8081" || rc.Domain != "krakend" || !rc.FailOpen ||
+		rc.Timeout != 100*time.Millisecond || len(rc.Descriptors) != 2 || len(rc.Descriptors[1]) != 2 {
+		t.Errorf("unexpected rls config: %+v", rc)
+		return
+	}
+	if e := rc.Descriptors[0][0]; e.Key != "remote_address" || e.Strategy != "ip" || e.Name != "X-Forwarded-For" {
+		t.Errorf("unexpected descriptor entry: %+v", e)
+	}
+	if e := rc.Descriptors[1][0]; e.Key != "generic_key" || e.Value != "api" || e.Strategy != "" {
+		t.Errorf("unexpected descriptor entry: %+v", e)
+	}
+	if _, err := RLSClientFromCfg(cfg); err != nil {
+		t.Error(err)
+	}
+
+	rls := dat[Namespace].(map[string]interface{})["rls"].(map[string]interface{})
+	for _, entry := range []map[string]interface{}{
+		{"value": "api"},
+		{"key": "user", "strategy": "cookie", "name": "session"},
+		{"key": "generic_key"},
+		{"key": "generic_key", "value": ""},
+	} {
+		rls["descriptors"] = []interface{}{
+			[]interface{}{entry},
+		}
+		if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for %v: %v", entry, err)
+		}
+	}
+	for _, descriptors := range []interface{}{nil, []interface{}{}, []interface{}{[]interface{}{}}} {
+		rls["descriptors"] = descriptors
+		if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+			t.Errorf("unexpected error for the descriptors %v: %v", descriptors, err)
+		}
+	}
+	rls["descriptors"] = []interface{}{[]interface{}{map[string]interface{}{"key": "generic_key", "value": "api"}}}
+	delete(rls, "domain")
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the rls backend should require a domain: %v", err)
+	}
+	delete(dat[Namespace].(map[string]interface{}), "rls")
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRLSClientFromCfg_tls(t *testing.T) {
+	cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+		"backend": "rls",
+		"rls": map[string]interface{}{
+			"address":     "127.0.0.1:8081",
+			"domain":      "krakend",
+			"tls":         true,
+			"descriptors": []interface{}{[]interface{}{map[string]interface{}{"key": "generic_key", "value": "api"}}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.RLS.TLS {
+		t.Errorf("unexpected rls config: %+v", cfg.RLS)
+	}
+	if _, err := RLSClientFromCfg(cfg); err != nil {
+		t.Error(err)
+	}
+
+	cfg.RLS.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := RLSClientFromCfg(cfg); err == nil {
+		t.Error("the client should fail without the CA file")
+	}
+}
+
+func TestConfigGetter_memcached(t *testing.T) {
+	serializedCfg := []byte(`{
+		"qos/ratelimit/router": {
+			"client_max_rate": 10,
+			"every": "1m",
+			"backend": "memcached",
+			"memcached": {
+				"servers": ["127.0.0.1:11211", "127.0.0.1:11212"],
+				"algorithm": "fixed_window",
+				"key_prefix": "rl:",
+				"fail_open": true
+			}
+		}
+	}`)
+	var dat config.ExtraConfig
+	if err := json.Unmarshal(serializedCfg, &dat); err != nil {
+		t.Error(err.Error())
+	}
+	cfg, err := ConfigGetter(dat)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	mc := cfg.Memcached
+	if cfg.Backend != "memcached" || len(mc.Servers) != 2 || mc.Algorithm != "fixed_window" || mc.KeyPrefix != "rl:" ||
+		!mc.FailOpen || mc.Window != time.Minute || mc.Timeout != 100*time.Millisecond {
+		t.Errorf("unexpected memcached config: %+v", mc)
+	}
+	if _, ok := StoreFromCfg(cfg)("client").(*memcached.FixedWindow); !ok {
+		t.Error("the limiters should be memcached fixed windows")
+	}
+
+	cfg.Memcached.Algorithm = "gcra"
+	if _, ok := StoreFromCfg(cfg)("client").(*memcached.GCRA); !ok {
+		t.Error("the limiters should be memcached GCRA limiters")
+	}
+
+	dat[Namespace].(map[string]interface{})["cost_header"] = "X-Cost"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the memcached backend should not accept the cost header: %v", err)
+	}
+	delete(dat[Namespace].(map[string]interface{}), "cost_header")
+
+	dat[Namespace].(map[string]interface{})["every"] = "1000h"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the memcached windows should not outlive the expiration of the items: %v", err)
+	}
+	dat[Namespace].(map[string]interface{})["every"] = "1m"
+
+	dat[Namespace].(map[string]interface{})["memcached"].(map[string]interface{})["algorithm"] = "gcra"
+	dat[Namespace].(map[string]interface{})["client_max_rate"] = 1e-6
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("the memcached GCRA states should not outlive the expiration of the items: %v", err)
+	}
+	dat[Namespace].(map[string]interface{})["client_max_rate"] = 10
+
+	dat[Namespace].(map[string]interface{})["memcached"].(map[string]interface{})["algorithm"] = "leaky_bucket"
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	delete(dat[Namespace].(map[string]interface{}), "memcached")
+	if _, err = ConfigGetter(dat); !errors.Is(err, ErrWrongExtraCfg) {
+		t.Errorf("unexpected error: %v", err)
+	}
 }
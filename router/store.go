@@ -2,27 +2,397 @@ package router
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	goredis "github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 
 	krakendrate "github.com/krakend/krakend-ratelimit/v3"
+	"github.com/krakend/krakend-ratelimit/v3/cluster"
+	"github.com/krakend/krakend-ratelimit/v3/gossip"
+	"github.com/krakend/krakend-ratelimit/v3/memcached"
+	"github.com/krakend/krakend-ratelimit/v3/redis"
+	"github.com/krakend/krakend-ratelimit/v3/rls"
 )
 
+// StoreFromCfg returns the store of the client limiters defined in the config. The limits are
+// enforced locally if the gossip node or the cluster membership can not be started. Use
+// NewStoreFromCfg to get the error
 func StoreFromCfg(cfg Config) krakendrate.LimiterStore {
+	store, err := NewStoreFromCfg(cfg)
+	if err != nil {
+		return LocalStoreFromCfg(cfg)
+	}
+	return store
+}
+
+// NewStoreFromCfg returns the store of the client limiters defined in the config, or an error if
+// the gossip node or the cluster membership can not be started, or if they or the gossip store
+// conflict with the ones of another endpoint
+func NewStoreFromCfg(cfg Config) (krakendrate.LimiterStore, error) {
+	switch cfg.Backend {
+	case "redis":
+		return redisStoreFromCfg(cfg), nil
+	case "memcached":
+		return memcachedStoreFromCfg(cfg), nil
+	}
+
+	storeBackend := memoryBackendFromCfg(cfg)
+	builder := limiterBuilderFromCfg(cfg)
+	if cfg.Backend == "gossip" {
+		node, err := gossipNodeFromCfg(cfg)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint := clientLimitsFingerprint(cfg)
+		name := cfg.Gossip.Name
+		if name == "" {
+			name = fingerprint
+		}
+		return node.Store(name, fingerprint, storeBackend, builder)
+	}
+	divider, err := DividerFromCfg(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if divider != nil {
+		return divider.Store(storeBackend, builder, cfg.ClientMaxRate, cfg.ClientCapacity), nil
+	}
+	return krakendrate.NewTypedLimiterStore(storeBackend, builder), nil
+}
+
+// LocalStoreFromCfg returns a store keeping the client limiters defined in the config in memory,
+// without sharing them with other nodes
+func LocalStoreFromCfg(cfg Config) krakendrate.LimiterStore {
+	return krakendrate.NewTypedLimiterStore(memoryBackendFromCfg(cfg), limiterBuilderFromCfg(cfg))
+}
+
+// clientLimitsFingerprint returns a hash of the client limits defined in the config
+func clientLimitsFingerprint(cfg Config) string {
+	limits := fmt.Sprintf("%s|%s|%g|%d|%s|%d|%s|%v|%v",
+		cfg.Strategy, cfg.Key, cfg.ClientMaxRate, cfg.ClientCapacity, cfg.Period, cfg.Quota,
+		cfg.Timezone, cfg.Schedule, cfg.ClientLimits)
+	return fmt.Sprintf("%016x", krakendrate.PseudoFNV64a(limits))
+}
+
+// memoryBackendFromCfg returns the in-memory backend keeping the limiters of the clients
+func memoryBackendFromCfg(cfg Config) krakendrate.TypedBackend[krakendrate.Limiter] {
 	ctx := context.Background()
-	var storeBackend krakendrate.Backend
 	if cfg.NumShards > 1 {
-		storeBackend = krakendrate.NewShardedBackend(
+		return krakendrate.NewTypedShardedBackend(
 			ctx,
 			cfg.NumShards,
 			cfg.TTL,
 			cfg.CleanUpPeriod,
 			1,
 			krakendrate.PseudoFNV64a,
-			krakendrate.MemoryBackendBuilder,
+			krakendrate.TypedMemoryBackendBuilder[krakendrate.Limiter],
 		)
-	} else {
-		storeBackend = krakendrate.MemoryBackendBuilder(ctx, cfg.TTL, cfg.CleanUpPeriod, 1, 1)[0]
 	}
+	return krakendrate.TypedMemoryBackendBuilder[krakendrate.Limiter](ctx, cfg.TTL, cfg.CleanUpPeriod, 1, 1)[0]
+}
+
+// limiterBuilderFromCfg returns the builder of the limiters to use for every client. When a
+// calendar period is configured, the clients get the Quota of requests for every period.
+func limiterBuilderFromCfg(cfg Config) func() krakendrate.Limiter {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	builder := tokenBucketBuilder(cfg.ClientMaxRate, cfg.ClientCapacity)
+	if period, err := krakendrate.ParseCalendarPeriod(cfg.Period); err == nil {
+		quota := cfg.Quota
+		builder = func() krakendrate.Limiter {
+			return krakendrate.NewCalendarQuota(quota, period, loc)
+		}
+	}
+	if len(cfg.Schedule) > 0 {
+		rules := make([]krakendrate.ScheduleRule, 0, len(cfg.Schedule))
+		for _, w := range cfg.Schedule {
+			window, err := krakendrate.ParseTimeWindow(w.Hours, w.Days)
+			if err != nil {
+				continue
+			}
+			rules = append(rules, krakendrate.ScheduleRule{
+				Window:  window,
+				Builder: tokenBucketBuilder(w.ClientMaxRate, w.ClientCapacity),
+			})
+		}
+		fallback := builder
+		builder = func() krakendrate.Limiter {
+			return krakendrate.NewScheduledLimiter(rules, fallback, loc)
+		}
+	}
+	if len(cfg.ClientLimits) == 0 {
+		return builder
+	}
+
+	builders := []func() krakendrate.Limiter{builder}
+	for _, l := range cfg.ClientLimits {
+		builders = append(builders, tokenBucketBuilder(l.MaxRate, l.Capacity))
+	}
+	return func() krakendrate.Limiter {
+		limiters := make([]krakendrate.Limiter, len(builders))
+		for i, b := range builders {
+			limiters[i] = b()
+		}
+		return krakendrate.NewCompositeLimiter(limiters...)
+	}
+}
+
+// tokenBucketBuilder returns the builder of full token buckets with the given rate and capacity
+func tokenBucketBuilder(rate float64, capacity uint64) func() krakendrate.Limiter {
+	return func() krakendrate.Limiter {
+		return krakendrate.NewTokenBucket(rate, capacity)
+	}
+}
+
+var (
+	redisClients   = map[string]*goredis.Client{}
+	redisClientsMu = new(sync.Mutex)
+)
+
+// redisStoreFromCfg returns a store keeping the client limiters in Redis. The clients are shared
+// by all the endpoints using the same server, credentials and database, and the keys are scoped
+// by the limits of the endpoint.
+func redisStoreFromCfg(cfg Config) krakendrate.LimiterStore {
+	key := fmt.Sprintf("%s/%d/%s", cfg.Redis.Address, cfg.Redis.DB, cfg.Redis.Password)
+	redisClientsMu.Lock()
+	client, ok := redisClients[key]
+	if !ok {
+		client = goredis.NewClient(&goredis.Options{
+			Addr:     cfg.Redis.Address,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		redisClients[key] = client
+	}
+	redisClientsMu.Unlock()
+
+	opts := redis.Options{
+		Timeout:  cfg.Redis.Timeout,
+		FailOpen: cfg.Redis.FailOpen,
+	}
+	if cfg.Redis.Algorithm == "sliding_window" {
+		limit := uint64(math.Ceil(cfg.ClientMaxRate * cfg.Redis.Window.Seconds()))
+		opts.KeyPrefix = scopedKeyPrefix(cfg.Redis.KeyPrefix, cfg.Redis.Algorithm, float64(limit), 0, cfg.Redis.Window)
+		return redis.NewSlidingWindowStore(client, limit, cfg.Redis.Window, opts)
+	}
+	// the leased tokens come from the same buckets used without leases
+	opts.KeyPrefix = scopedKeyPrefix(cfg.Redis.KeyPrefix, cfg.Redis.Algorithm, cfg.ClientMaxRate, cfg.ClientCapacity, 0)
+	if cfg.Redis.LeaseSize > 0 {
+		// the tokens are leased in batches and consumed by limiters kept in memory
+		leaser := redis.NewTokenLeaser(client, cfg.ClientMaxRate, cfg.ClientCapacity, opts)
+		return krakendrate.NewLeasedLimiterStore(leaser, memoryBackendFromCfg(cfg), krakendrate.LeaseOptions{
+			Size:     cfg.Redis.LeaseSize,
+			TTL:      cfg.Redis.LeaseTTL,
+			Timeout:  cfg.Redis.Timeout,
+			FailOpen: cfg.Redis.FailOpen,
+		}, nil)
+	}
+	return redis.NewTokenBucketStore(client, cfg.ClientMaxRate, cfg.ClientCapacity, opts)
+}
+
+// scopedKeyPrefix returns the prefix of the keys of the remote limiters with the given limits, so
+// the endpoints with different limits never share the counters of a client
+func scopedKeyPrefix(prefix, algorithm string, rate float64, capacity uint64, window time.Duration) string {
+	limits := fmt.Sprintf("%s|%g|%d|%s", algorithm, rate, capacity, window)
+	return fmt.Sprintf("%s%016x:", prefix, krakendrate.PseudoFNV64a(limits))
+}
+
+var (
+	memcachedClients   = map[string]*memcache.Client{}
+	memcachedClientsMu = new(sync.Mutex)
+)
+
+// memcachedStoreFromCfg returns a store keeping the client limiters in memcached. The clients are
+// shared by all the endpoints using the same list of servers and timeout, and the keys are scoped
+// by the limits of the endpoint.
+func memcachedStoreFromCfg(cfg Config) krakendrate.LimiterStore {
+	key := fmt.Sprintf("%s/%s", strings.Join(cfg.Memcached.Servers, ","), cfg.Memcached.Timeout)
+	memcachedClientsMu.Lock()
+	client, ok := memcachedClients[key]
+	if !ok {
+		client = memcache.New(cfg.Memcached.Servers...)
+		client.Timeout = cfg.Memcached.Timeout
+		memcachedClients[key] = client
+	}
+	memcachedClientsMu.Unlock()
+
+	opts := memcached.Options{
+		FailOpen: cfg.Memcached.FailOpen,
+	}
+	if cfg.Memcached.Algorithm == "fixed_window" {
+		limit := uint64(math.Ceil(cfg.ClientMaxRate * cfg.Memcached.Window.Seconds()))
+		opts.KeyPrefix = scopedKeyPrefix(cfg.Memcached.KeyPrefix, cfg.Memcached.Algorithm, float64(limit), 0, cfg.Memcached.Window)
+		return memcached.NewFixedWindowStore(client, limit, cfg.Memcached.Window, opts)
+	}
+	opts.KeyPrefix = scopedKeyPrefix(cfg.Memcached.KeyPrefix, cfg.Memcached.Algorithm, cfg.ClientMaxRate, cfg.ClientCapacity, 0)
+	return memcached.NewGCRAStore(client, cfg.ClientMaxRate, cfg.ClientCapacity, opts)
+}
+
+// sharedNode is a gossip node or a cluster divider shared by several endpoints, along with the
+// settings it was started with
+type sharedNode[T any] struct {
+	node     T
+	settings string
+}
+
+var (
+	gossipNodes   = map[string]sharedNode[*gossip.Node]{}
+	gossipNodesMu = new(sync.Mutex)
+)
+
+// gossipNodeFromCfg returns the gossip node listening to the address of the config, starting it
+// if required. The nodes are shared by all the endpoints using the same address, so they must
+// agree on the rest of the settings of the node.
+func gossipNodeFromCfg(cfg Config) (*gossip.Node, error) {
+	gc := gossip.Config{
+		Bind:     cfg.Gossip.Bind,
+		Peers:    cfg.Gossip.Peers,
+		Interval: cfg.Gossip.Interval,
+		Shards:   max(cfg.NumShards, 1),
+		Secret:   cfg.Gossip.Secret,
+	}
+	settings := fmt.Sprintf("%s|%s|%d|%s", strings.Join(gc.Peers, ","), gc.Interval, gc.Shards, gc.Secret)
+
+	gossipNodesMu.Lock()
+	defer gossipNodesMu.Unlock()
+
+	if n, ok := gossipNodes[gc.Bind]; ok {
+		if n.settings != settings {
+			return nil, fmt.Errorf("%w: the gossip node of %s is running with other peers, interval, shards or secret",
+				ErrConflictingCfg, gc.Bind)
+		}
+		return n.node, nil
+	}
+	node, err := gossip.New(context.Background(), gc)
+	if err != nil {
+		return nil, err
+	}
+	gossipNodes[gc.Bind] = sharedNode[*gossip.Node]{node: node, settings: settings}
+	return node, nil
+}
+
+var (
+	dividers   = map[string]sharedNode[*cluster.Divider]{}
+	dividersMu = new(sync.Mutex)
+)
+
+// DividerFromCfg returns the divider rescaling the limiters to the size of the cluster defined in
+// the config, nil if the limits are not divided, or an error if the membership can not be started.
+// The dividers are shared by all the endpoints using the same heartbeat directory, bind address or
+// static list of peers, so they must agree on the rest of the settings of the membership.
+func DividerFromCfg(cfg Config) (*cluster.Divider, error) {
+	c := cfg.Cluster
+	if !c.Enabled() {
+		return nil, nil
+	}
+	var key string
+	switch {
+	case c.HeartbeatDir != "":
+		key = "dir|" + c.HeartbeatDir
+	case c.Bind != "":
+		key = "bind|" + c.Bind
+	default:
+		key = "static|" + strings.Join(c.Peers, ",")
+	}
+	settings := fmt.Sprintf("%s|%s|%s|%s|%s|%s", c.HeartbeatDir, c.Bind, strings.Join(c.Peers, ","),
+		c.NodeID, c.Interval, c.TTL)
+
+	dividersMu.Lock()
+	defer dividersMu.Unlock()
+	if d, ok := dividers[key]; ok {
+		if d.settings != settings {
+			return nil, fmt.Errorf("%w: the cluster membership of %s is running with other settings",
+				ErrConflictingCfg, key)
+		}
+		return d.node, nil
+	}
+
+	ctx := context.Background()
+	var m cluster.Membership
+	switch {
+	case c.HeartbeatDir != "":
+		fh, err := cluster.NewFileHeartbeat(ctx, cluster.FileHeartbeatConfig{
+			Dir:      c.HeartbeatDir,
+			ID:       c.NodeID,
+			Interval: c.Interval,
+			TTL:      c.TTL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		m = fh
+	case c.Bind != "":
+		h, err := cluster.NewHeartbeat(ctx, cluster.HeartbeatConfig{
+			Bind:     c.Bind,
+			Peers:    c.Peers,
+			Interval: c.Interval,
+			TTL:      c.TTL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		m = h
+	default:
+		m = cluster.NewStatic(c.Peers)
+	}
+
+	d := cluster.NewDivider(ctx, m, c.Interval)
+	dividers[key] = sharedNode[*cluster.Divider]{node: d, settings: settings}
+	return d, nil
+}
+
+var (
+	rlsClients   = map[string]*grpc.ClientConn{}
+	rlsClientsMu = new(sync.Mutex)
+)
+
+// RLSClientFromCfg returns a client of the rate limit service defined in the config. The gRPC
+// connections are shared by all the endpoints using the same address and transport.
+func RLSClientFromCfg(cfg Config) (*rls.Client, error) {
+	key := fmt.Sprintf("%s|%t|%s", cfg.RLS.Address, cfg.RLS.TLS, cfg.RLS.CAFile)
+
+	rlsClientsMu.Lock()
+	defer rlsClientsMu.Unlock()
+
+	conn, ok := rlsClients[key]
+	if !ok {
+		creds, err := rlsCredentialsFromCfg(cfg)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = grpc.NewClient(cfg.RLS.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		rlsClients[key] = conn
+	}
+	return rls.New(conn, rls.Options{
+		Domain:   cfg.RLS.Domain,
+		Timeout:  cfg.RLS.Timeout,
+		FailOpen: cfg.RLS.FailOpen,
+	}), nil
+}
 
-	return krakendrate.NewLimiterStore(cfg.ClientMaxRate, int(cfg.ClientCapacity),
-		storeBackend)
+// rlsCredentialsFromCfg returns the transport credentials of the connections to the rate limit
+// service: TLS verified with the CA file or the system roots, or plaintext if TLS is disabled
+func rlsCredentialsFromCfg(cfg Config) (credentials.TransportCredentials, error) {
+	if !cfg.RLS.TLS {
+		return insecure.NewCredentials(), nil
+	}
+	if cfg.RLS.CAFile == "" {
+		return credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12}), nil
+	}
+	return credentials.NewClientTLSFromFile(cfg.RLS.CAFile, "")
 }
@@ -0,0 +1,234 @@
+package krakendrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWrongTimeWindow is the error returned when parsing a malformed time window
+var ErrWrongTimeWindow = errors.New("wrong time window")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily range of hours, optionally restricted to some days of the week. Windows
+// ending before they start, like 22:00-06:00, span midnight and belong to the day they start.
+type TimeWindow struct {
+	// From is the offset from midnight where the window starts
+	From time.Duration
+	// To is the offset from midnight where the window ends
+	To time.Duration
+	// Days are the days of the week when the window starts. An empty list means every day.
+	Days []time.Weekday
+}
+
+// ParseTimeWindow returns the TimeWindow defined by a range of hours with the format HH:MM-HH:MM
+// and a list of days of the week. Every day can be either a three letter name (mon, tue...) or a
+// range of them, like mon-fri.
+func ParseTimeWindow(hours string, days []string) (TimeWindow, error) {
+	w := TimeWindow{}
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("%w: %q", ErrWrongTimeWindow, hours)
+	}
+	var err error
+	if w.From, err = parseTimeOfDay(from); err != nil {
+		return w, err
+	}
+	if w.From == 24*time.Hour {
+		return w, fmt.Errorf("%w: the window can not start at 24:00 %q", ErrWrongTimeWindow, hours)
+	}
+	if w.To, err = parseTimeOfDay(to); err != nil {
+		return w, err
+	}
+	if w.From == w.To {
+		return w, fmt.Errorf("%w: empty range %q", ErrWrongTimeWindow, hours)
+	}
+
+	for _, d := range days {
+		first, last, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "-")
+		start, ok := weekdays[first]
+		if !ok {
+			return w, fmt.Errorf("%w: unknown day %q", ErrWrongTimeWindow, d)
+		}
+		end := start
+		if isRange {
+			if end, ok = weekdays[last]; !ok {
+				return w, fmt.Errorf("%w: unknown day %q", ErrWrongTimeWindow, d)
+			}
+		}
+		for wd := start; ; wd = (wd + 1) % 7 {
+			w.Days = append(w.Days, wd)
+			if wd == end {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		// 24:00 is accepted as the end of the day, but not as its start
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("%w: %q", ErrWrongTimeWindow, s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains flags if the instant t, already in the location of the schedule, is inside the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	// the wall clock time, so the windows keep their hours on the days of the DST transitions
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	day := t.Weekday()
+
+	if w.From < w.To {
+		return offset >= w.From && offset < w.To && w.onDay(day)
+	}
+	// the window spans midnight, so the first hours of the day belong to the window
+	// started the day before
+	if offset >= w.From {
+		return w.onDay(day)
+	}
+	return offset < w.To && w.onDay((day+6)%7)
+}
+
+func (w TimeWindow) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, wd := range w.Days {
+		if wd == d {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleRule binds a time window to the builder of the limiters to use during it
+type ScheduleRule struct {
+	Window  TimeWindow
+	Builder func() Limiter
+}
+
+// NewScheduledLimiter returns a limiter switching between the limiters of the first rule
+// matching the current time in the given location and the fallback one, using the default clock
+func NewScheduledLimiter(rules []ScheduleRule, fallback func() Limiter, loc *time.Location) *ScheduledLimiter {
+	return NewScheduledLimiterBuilder(rules, fallback, loc, nil)().(*ScheduledLimiter)
+}
+
+// NewScheduledLimiterBuilder returns a LimiterBuilderFn creating scheduled limiters with the
+// given rules, fallback builder, location and clock. A nil location means UTC.
+func NewScheduledLimiterBuilder(rules []ScheduleRule, fallback func() Limiter, loc *time.Location, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return func() interface{} {
+		return &ScheduledLimiter{
+			rules:    rules,
+			fallback: fallback,
+			location: loc,
+			clock:    clk,
+			limiters: make([]Limiter, len(rules)+1),
+			mu:       new(sync.Mutex),
+		}
+	}
+}
+
+// ScheduledLimiter delegates to a different limiter depending on the time of the day. The
+// rules are checked in order and the fallback limiter is used when none of them matches.
+//
+// Every rule and the fallback keep their own limiter, built the first time they are active and
+// reused every time they become active again. The requests accepted during a window are not
+// taken into account by the rest of them, but switching windows never resets the state of a
+// limiter, so a quota is not renewed at every boundary of the schedule.
+type ScheduledLimiter struct {
+	rules    []ScheduleRule
+	fallback func() Limiter
+	location *time.Location
+	clock    Clock
+	// limiters are the limiters of the rules, followed by the fallback one. They are nil until
+	// their window is active for the first time
+	limiters []Limiter
+	mu       *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not by the limiter of the active
+// window. It updates the internal state if the request can be processed
+func (s *ScheduledLimiter) Allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active().Allow()
+}
+
+// Refund gives n tokens back to the limiter of the active window, if it supports refunds
+func (s *ScheduledLimiter) Refund(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.active().(RefundableLimiter); ok {
+		r.Refund(n)
+	}
+}
+
+// Charge takes n tokens from the limiter of the active window, if it supports charges
+func (s *ScheduledLimiter) Charge(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.active().(ChargeableLimiter); ok {
+		c.Charge(n)
+	}
+}
+
+// State returns the state of the limiter of the active window. A zero state is returned if it
+// does not implement the StatefulLimiter interface
+func (s *ScheduledLimiter) State() LimiterState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sl, ok := s.active().(StatefulLimiter); ok {
+		return sl.State()
+	}
+	return LimiterState{}
+}
+
+// active returns the limiter of the window matching the current time, building it the first
+// time the window is active
+func (s *ScheduledLimiter) active() Limiter {
+	now := s.clock.Now().In(s.location)
+	idx := len(s.rules)
+	for i, r := range s.rules {
+		if r.Window.Contains(now) {
+			idx = i
+			break
+		}
+	}
+	if s.limiters[idx] == nil {
+		if idx < len(s.rules) {
+			s.limiters[idx] = s.rules[idx].Builder()
+		} else {
+			s.limiters[idx] = s.fallback()
+		}
+	}
+	return s.limiters[idx]
+}
@@ -0,0 +1,137 @@
+package krakendrate
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	w, err := ParseTimeWindow("22:30-06:00", []string{"fri-mon", "wed"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.From != 22*time.Hour+30*time.Minute || w.To != 6*time.Hour {
+		t.Errorf("unexpected range: %s-%s", w.From, w.To)
+	}
+	want := []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday, time.Wednesday}
+	if len(w.Days) != len(want) {
+		t.Errorf("unexpected days: %v", w.Days)
+		return
+	}
+	for i, d := range want {
+		if w.Days[i] != d {
+			t.Errorf("unexpected days: %v", w.Days)
+		}
+	}
+
+	for _, tc := range []struct {
+		hours string
+		days  []string
+	}{
+		{hours: "9-18"},
+		{hours: "09:00"},
+		{hours: "09:00-09:00"},
+		{hours: "24:00-06:00"},
+		{hours: "09:00-18:00", days: []string{"someday"}},
+	} {
+		if _, err := ParseTimeWindow(tc.hours, tc.days); !errors.Is(err, ErrWrongTimeWindow) {
+			t.Errorf("%s %v: unexpected error: %v", tc.hours, tc.days, err)
+		}
+	}
+}
+
+func TestTimeWindow_Contains(t *testing.T) {
+	// from Friday night to Saturday morning
+	w, _ := ParseTimeWindow("22:00-06:00", []string{"fri"})
+	for _, tc := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{t: time.Date(2024, 1, 5, 21, 59, 0, 0, time.UTC), want: false},
+		{t: time.Date(2024, 1, 5, 22, 0, 0, 0, time.UTC), want: true},
+		{t: time.Date(2024, 1, 6, 5, 59, 0, 0, time.UTC), want: true},
+		{t: time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC), want: false},
+		{t: time.Date(2024, 1, 6, 23, 0, 0, 0, time.UTC), want: false},
+		{t: time.Date(2024, 1, 5, 2, 0, 0, 0, time.UTC), want: false},
+	} {
+		if got := w.Contains(tc.t); got != tc.want {
+			t.Errorf("%s: want %v, have %v", tc.t, tc.want, got)
+		}
+	}
+
+	w, _ = ParseTimeWindow("09:00-24:00", nil)
+	if !w.Contains(time.Date(2024, 1, 5, 23, 59, 0, 0, time.UTC)) {
+		t.Error("the window should last until midnight")
+	}
+}
+
+func TestScheduledLimiter(t *testing.T) {
+	clk := newTestClock()
+	clk.Set(time.Date(2024, 1, 8, 8, 59, 0, 0, time.UTC)) // a Monday
+	peak, _ := ParseTimeWindow("09:00-18:00", []string{"mon-fri"})
+	l := NewScheduledLimiterBuilder(
+		[]ScheduleRule{{Window: peak, Builder: func() Limiter { return NewTokenBucketWithClock(1e-6, 1, clk) }}},
+		func() Limiter { return NewTokenBucketWithClock(1e-6, 3, clk) },
+		time.UTC,
+		clk,
+	)().(*ScheduledLimiter)
+
+	if !l.Allow() || !l.Allow() {
+		t.Error("the requests should be allowed by the fallback limiter")
+	}
+	if st := l.State(); st.Limit != 3 || st.Remaining != 1 {
+		t.Errorf("unexpected state of the fallback limiter: %+v", st)
+	}
+
+	clk.Add(time.Minute)
+	if !l.Allow() {
+		t.Error("the first request of the peak window should be allowed by a fresh limiter")
+	}
+	if l.Allow() {
+		t.Error("the second request of the peak window should be rejected")
+	}
+	l.Refund(1)
+	if !l.Allow() {
+		t.Error("the refunded token should be available")
+	}
+
+	clk.Set(time.Date(2024, 1, 8, 18, 0, 0, 0, time.UTC))
+	if !l.Allow() {
+		t.Error("the token left in the fallback limiter should be available")
+	}
+	if l.Allow() {
+		t.Error("the fallback limiter should keep its state across the switches")
+	}
+
+	clk.Set(time.Date(2024, 1, 9, 9, 0, 0, 0, time.UTC))
+	if l.Allow() {
+		t.Error("the peak limiter should keep its state across the switches")
+	}
+}
+
+func TestTimeWindow_Contains_dst(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip(err)
+	}
+	w, _ := ParseTimeWindow("09:00-18:00", nil)
+	// the clocks go forward at 02:00 on 2024-03-31 and back at 03:00 on 2024-10-27
+	for _, day := range []int{31 + 29 + 31, 300 + 1} {
+		for _, tc := range []struct {
+			hour, minute int
+			want         bool
+		}{
+			{hour: 8, minute: 59, want: false},
+			{hour: 9, want: true},
+			{hour: 17, minute: 59, want: true},
+			{hour: 18, want: false},
+		} {
+			now := time.Date(2024, 1, day, tc.hour, tc.minute, 0, 0, loc)
+			if got := w.Contains(now); got != tc.want {
+				t.Errorf("%s: want %v, have %v", now, tc.want, got)
+			}
+		}
+	}
+}
@@ -10,11 +10,18 @@ type Hasher func(string) uint64
 
 // BackendBuilder is the type for a function that can build a Backend.
 // Is is used by the ShardedMemoryBackend to create several backends / shards.
-type BackendBuilder func(ctx context.Context, ttl time.Duration, cleanUpRate time.Duration, cleanUpThreads uint64, amount uint64) []Backend
+type BackendBuilder = TypedBackendBuilder[interface{}]
+
+// TypedBackendBuilder is the type for a function that can build several TypedBackends.
+// Is is used by the TypedShardedBackend to create its shards.
+type TypedBackendBuilder[T any] func(ctx context.Context, ttl time.Duration, cleanUpRate time.Duration, cleanUpThreads uint64, amount uint64) []TypedBackend[T]
 
 // ShardedMemoryBackend is a memory backend shardering the data in order to avoid mutex contention
-type ShardedMemoryBackend struct {
-	shards []Backend
+type ShardedMemoryBackend = TypedShardedBackend[interface{}]
+
+// TypedShardedBackend is a TypedBackend shardering the data in order to avoid mutex contention
+type TypedShardedBackend[T any] struct {
+	shards []TypedBackend[T]
 	total  uint64
 	hasher Hasher
 }
@@ -28,7 +35,15 @@ func NewShardedMemoryBackend(ctx context.Context, shards uint64, ttl time.Durati
 func NewShardedBackend(ctx context.Context, shards uint64, ttl time.Duration,
 	cleanUpRate time.Duration, cleanUpThreads uint64, h Hasher, backendBuilder BackendBuilder,
 ) *ShardedMemoryBackend {
-	b := &ShardedMemoryBackend{
+	return NewTypedShardedBackend(ctx, shards, ttl, cleanUpRate, cleanUpThreads, h, backendBuilder)
+}
+
+// NewTypedShardedBackend returns a TypedShardedBackend with 'shards' shards created by the
+// received builder
+func NewTypedShardedBackend[T any](ctx context.Context, shards uint64, ttl time.Duration,
+	cleanUpRate time.Duration, cleanUpThreads uint64, h Hasher, backendBuilder TypedBackendBuilder[T],
+) *TypedShardedBackend[T] {
+	b := &TypedShardedBackend[T]{
 		shards: backendBuilder(ctx, ttl, cleanUpRate, cleanUpThreads, shards),
 		total:  shards,
 		hasher: h,
@@ -36,16 +51,59 @@ func NewShardedBackend(ctx context.Context, shards uint64, ttl time.Duration,
 	return b
 }
 
-func (b *ShardedMemoryBackend) shard(key string) uint64 {
+func (b *TypedShardedBackend[T]) shard(key string) uint64 {
 	return b.hasher(key) % b.total
 }
 
-// Load implements the Backend interface
-func (b *ShardedMemoryBackend) Load(key string, f func() interface{}) interface{} {
+// Load implements the TypedBackend interface
+func (b *TypedShardedBackend[T]) Load(key string, f func() T) T {
 	return b.shards[b.shard(key)].Load(key, f)
 }
 
-// Store implements the Backend interface
-func (b *ShardedMemoryBackend) Store(key string, v interface{}) error {
+// Store implements the TypedBackend interface
+func (b *TypedShardedBackend[T]) Store(key string, v T) error {
 	return b.shards[b.shard(key)].Store(key, v)
 }
+
+// LoadContext implements the TypedContextBackend interface
+func (b *TypedShardedBackend[T]) LoadContext(ctx context.Context, key string, f func() T) (T, error) {
+	return NewContextBackend(b.shards[b.shard(key)]).LoadContext(ctx, key, f)
+}
+
+// StoreContext implements the TypedContextBackend interface
+func (b *TypedShardedBackend[T]) StoreContext(ctx context.Context, key string, v T) error {
+	return NewContextBackend(b.shards[b.shard(key)]).StoreContext(ctx, key, v)
+}
+
+// Delete implements the TypedContextBackend interface
+func (b *TypedShardedBackend[T]) Delete(ctx context.Context, key string) error {
+	return NewContextBackend(b.shards[b.shard(key)]).Delete(ctx, key)
+}
+
+// Range implements the TypedContextBackend interface, iterating over the shards in order
+func (b *TypedShardedBackend[T]) Range(ctx context.Context, f func(key string, v T) bool) error {
+	stopped := false
+	for _, s := range b.shards {
+		err := NewContextBackend(s).Range(ctx, func(k string, v T) bool {
+			stopped = !f(k, v)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len implements the TypedContextBackend interface, adding the length of all the shards
+func (b *TypedShardedBackend[T]) Len(ctx context.Context) (int, error) {
+	total := 0
+	for _, s := range b.shards {
+		l, err := NewContextBackend(s).Len(ctx)
+		if err != nil {
+			return total, err
+		}
+		total += l
+	}
+	return total, nil
+}
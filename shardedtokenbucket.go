@@ -0,0 +1,142 @@
+package krakendrate
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"time"
+)
+
+// NewShardedTokenBucket returns a token bucket with the given rate and capacity split into shards
+// sub-buckets, using the default clock. If shards is 0, it creates a shard for every P
+// (see runtime.GOMAXPROCS).
+func NewShardedTokenBucket(rate float64, capacity, shards uint64) *ShardedTokenBucket {
+	return NewShardedTokenBucketWithClock(rate, capacity, shards, nil)
+}
+
+// NewShardedTokenBucketWithClock returns a token bucket with the given rate and capacity split into
+// shards sub-buckets, using the received clock. If shards is 0, it creates a shard for every P
+// (see runtime.GOMAXPROCS).
+func NewShardedTokenBucketWithClock(rate float64, capacity, shards uint64, c Clock) *ShardedTokenBucket {
+	if c == nil {
+		c = defaultClock{}
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	if shards == 0 {
+		shards = uint64(runtime.GOMAXPROCS(0))
+	}
+	// every shard must be able to hold at least a token
+	if shards > capacity {
+		shards = capacity
+	}
+
+	t := &ShardedTokenBucket{
+		shards:   make([]tokenBucketShard, shards),
+		capacity: capacity,
+		clock:    c,
+	}
+	shardRate := rate / float64(shards)
+	for i := range t.shards {
+		// the remainder of the capacity is spread across the first shards
+		shardCapacity := capacity / shards
+		if uint64(i) < capacity%shards {
+			shardCapacity++
+		}
+		t.shards[i].init(shardRate, shardCapacity, c)
+	}
+	return t
+}
+
+// tokenBucketShard is padded so every shard takes its own cache lines
+type tokenBucketShard struct {
+	AtomicTokenBucket
+	_ [64]byte
+}
+
+// ShardedTokenBucket is a token bucket splitting its rate and capacity across several lock-free
+// sub-buckets in order to reduce the contention of the limiters shared by all the requests of an
+// endpoint. Every request starts with a random shard and, when that shard runs dry, it steals the
+// tokens from its neighbours. The shards are picked with the top-level generator of math/rand/v2,
+// which does not share any state between threads, so concurrent requests spread over the shards
+// without contending for the generator. The aggregated rate and capacity are the configured ones,
+// but the tokens of a request are always taken from a single shard.
+type ShardedTokenBucket struct {
+	shards   []tokenBucketShard
+	capacity uint64
+	clock    Clock
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (t *ShardedTokenBucket) Allow() bool {
+	return t.AllowN(1)
+}
+
+// AllowN flags if n tokens can be consumed from any of the shards or not. It updates the internal
+// state if the tokens can be consumed. Since the tokens are not taken from several shards at once,
+// n must not exceed the capacity of a shard (the capacity of the bucket divided by the number of
+// shards), even when the shards hold enough tokens together
+func (t *ShardedTokenBucket) AllowN(n uint64) bool {
+	now := t.clock.Now().UnixNano()
+	start := rand.Uint64N(uint64(len(t.shards)))
+	for i := range uint64(len(t.shards)) {
+		if t.shards[(start+i)%uint64(len(t.shards))].allowAt(n, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve takes n tokens from the first shard able to provide them right now or, if none of them
+// can, it reserves them in a random shard. The reservation is not OK if n exceeds the capacity of
+// the shards.
+func (t *ShardedTokenBucket) Reserve(n uint64) *Reservation {
+	now := t.clock.Now()
+	nowNano := now.UnixNano()
+	start := rand.Uint64N(uint64(len(t.shards)))
+	for i := range uint64(len(t.shards)) {
+		shard := &t.shards[(start+i)%uint64(len(t.shards))]
+		if shard.allowAt(n, nowNano) {
+			return &Reservation{
+				ok:        true,
+				tokens:    n,
+				timeToAct: now,
+				clock:     t.clock,
+				refund:    shard.Refund,
+			}
+		}
+	}
+	return t.shards[start].Reserve(n)
+}
+
+// Refund gives n tokens back to a random shard
+func (t *ShardedTokenBucket) Refund(n uint64) {
+	t.shards[rand.Uint64N(uint64(len(t.shards)))].Refund(n)
+}
+
+// Charge takes n tokens from a random shard after the fact, putting it into debt if required
+func (t *ShardedTokenBucket) Charge(n uint64) {
+	t.shards[rand.Uint64N(uint64(len(t.shards)))].Charge(n)
+}
+
+// State returns the aggregated state of all the shards
+func (t *ShardedTokenBucket) State() LimiterState {
+	now := t.clock.Now().UnixNano()
+	st := LimiterState{Limit: t.capacity}
+	var retryAfter time.Duration
+	for i := range t.shards {
+		s := t.shards[i].stateAt(now)
+		st.Remaining += s.Remaining
+		if s.Reset > st.Reset {
+			st.Reset = s.Reset
+		}
+		if i == 0 || s.RetryAfter < retryAfter {
+			retryAfter = s.RetryAfter
+		}
+	}
+	if st.Remaining == 0 {
+		st.RetryAfter = retryAfter
+	}
+	return st
+}
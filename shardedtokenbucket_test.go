@@ -0,0 +1,87 @@
+package krakendrate
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedTokenBucket(t *testing.T) {
+	clk := newTestClock()
+	tb := NewShardedTokenBucketWithClock(10, 10, 4, clk)
+
+	if st := tb.State(); st != (LimiterState{Limit: 10, Remaining: 10}) {
+		t.Errorf("unexpected state of a full bucket: %+v", st)
+	}
+
+	// the tokens of all the shards are available through stealing
+	for i := 0; i < 10; i++ {
+		if !tb.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+	if st := tb.State(); st.Remaining != 0 || st.RetryAfter != 400*time.Millisecond {
+		t.Errorf("unexpected state of an empty bucket: %+v", st)
+	}
+
+	// every shard generates 2.5 tokens per second, so after a second each one of them
+	// holds 2 full tokens
+	clk.Add(time.Second)
+	allowed := 0
+	for tb.Allow() {
+		allowed++
+	}
+	if allowed != 8 {
+		t.Errorf("unexpected number of tokens after a second: %d", allowed)
+	}
+
+	r := tb.Reserve(1)
+	if !r.OK() || r.Delay() == 0 {
+		t.Errorf("the reservation should be delayed: %s", r.Delay())
+	}
+	r.Cancel()
+}
+
+func TestShardedTokenBucket_allowNAboveShardCapacity(t *testing.T) {
+	tb := NewShardedTokenBucketWithClock(10, 10, 2, newTestClock())
+	if tb.AllowN(6) {
+		t.Error("the tokens should not be taken from several shards")
+	}
+	if !tb.AllowN(5) {
+		t.Error("the tokens of a single shard should be available")
+	}
+}
+
+func TestShardedTokenBucket_moreShardsThanCapacity(t *testing.T) {
+	tb := NewShardedTokenBucket(1, 3, 16)
+	if len(tb.shards) != 3 {
+		t.Errorf("unexpected number of shards: %d", len(tb.shards))
+	}
+}
+
+func TestShardedTokenBucket_concurrency(t *testing.T) {
+	tb := NewShardedTokenBucket(1e-3, 1000, 8)
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if tb.Allow() {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1000 {
+		t.Errorf("unexpected number of allowed requests: %d", allowed)
+	}
+}
@@ -0,0 +1,147 @@
+package krakendrate
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// NewSlidingWindowCounter returns a sliding window counter limiter allowing up to limit
+// requests per window, using the default clock
+func NewSlidingWindowCounter(limit uint64, window time.Duration) *SlidingWindowCounter {
+	return NewSlidingWindowCounterWithClock(limit, window, nil)
+}
+
+// NewSlidingWindowCounterWithClock returns a sliding window counter limiter allowing up to
+// limit requests per window, using the received clock
+func NewSlidingWindowCounterWithClock(limit uint64, window time.Duration, c Clock) *SlidingWindowCounter {
+	return NewSlidingWindowCounterBuilder(limit, window, c)().(*SlidingWindowCounter)
+}
+
+// NewSlidingWindowCounterBuilder returns a LimiterBuilderFn creating sliding window counter
+// limiters with the given limit, window and clock
+func NewSlidingWindowCounterBuilder(limit uint64, window time.Duration, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = time.Second
+	}
+
+	return func() interface{} {
+		return &SlidingWindowCounter{
+			limit:       limit,
+			window:      window,
+			clock:       clk,
+			windowStart: clk.Now().Truncate(window),
+			mu:          new(sync.Mutex),
+		}
+	}
+}
+
+// SlidingWindowCounter is an implementation of the sliding window counter pattern. It only
+// keeps the counters of the current and the previous fixed windows and it estimates the
+// number of requests in the sliding window by weighting the previous counter with the
+// portion of the previous window still covered by the sliding one.
+type SlidingWindowCounter struct {
+	limit       uint64
+	window      time.Duration
+	clock       Clock
+	windowStart time.Time
+	current     uint64
+	previous    uint64
+	mu          *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (s *SlidingWindowCounter) Allow() bool {
+	s.mu.Lock()
+	r := s.canConsume()
+	s.mu.Unlock()
+	return r
+}
+
+func (s *SlidingWindowCounter) canConsume() bool {
+	n := s.clock.Now()
+	s.rotate(n)
+
+	// weight of the previous window in the current sliding one
+	weight := 1 - float64(n.Sub(s.windowStart))/float64(s.window)
+	if float64(s.previous)*weight+float64(s.current) >= float64(s.limit) {
+		return false
+	}
+
+	s.current++
+	return true
+}
+
+// Refund gives n requests back to the current window
+func (s *SlidingWindowCounter) Refund(n uint64) {
+	s.mu.Lock()
+	if n > s.current {
+		n = s.current
+	}
+	s.current -= n
+	s.mu.Unlock()
+}
+
+// rotate moves the fixed windows forward so the current one contains the instant n
+func (s *SlidingWindowCounter) rotate(n time.Time) {
+	elapsed := n.Sub(s.windowStart)
+	if elapsed < s.window {
+		return
+	}
+
+	if elapsed < 2*s.window {
+		s.previous = s.current
+	} else {
+		// more than a full window without traffic
+		s.previous = 0
+	}
+	s.current = 0
+	s.windowStart = s.windowStart.Add(elapsed - elapsed%s.window)
+}
+
+// State returns the current state of the limiter
+func (s *SlidingWindowCounter) State() LimiterState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.clock.Now()
+	s.rotate(n)
+	elapsed := n.Sub(s.windowStart)
+	weight := 1 - float64(elapsed)/float64(s.window)
+	estimation := float64(s.previous)*weight + float64(s.current)
+	limit := float64(s.limit)
+
+	st := LimiterState{Limit: s.limit}
+	if estimation < limit {
+		st.Remaining = uint64(math.Ceil(limit - estimation))
+	}
+
+	switch {
+	case s.current > 0:
+		st.Reset = 2*s.window - elapsed
+	case s.previous > 0:
+		st.Reset = s.window - elapsed
+	}
+
+	if st.Remaining > 0 {
+		return st
+	}
+	if s.current < s.limit {
+		// the weight of the previous window must decrease until the estimation is below the limit
+		st.RetryAfter = time.Duration(float64(s.window)*(1-(limit-float64(s.current))/float64(s.previous))) - elapsed
+	} else {
+		// the current window must become the previous one and decrease its weight
+		st.RetryAfter = s.window - elapsed + time.Duration(float64(s.window)*(1-limit/float64(s.current)))
+	}
+	if st.RetryAfter < 0 {
+		st.RetryAfter = 0
+	}
+	return st
+}
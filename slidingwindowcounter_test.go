@@ -0,0 +1,80 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowCounter(t *testing.T) {
+	clk := newTestClock()
+	sw := NewSlidingWindowCounterWithClock(10, time.Minute, clk)
+
+	for i := 0; i < 10; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the 11th request should be rejected")
+	}
+
+	// a quarter of the next window: the estimation is 10*0.75 = 7.5 so 3 more requests
+	// should be allowed
+	clk.Add(time.Minute + 15*time.Second)
+	for i := 0; i < 3; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed in the second window", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the 4th request in the second window should be rejected")
+	}
+
+	// half of the window: 3*0.5 + 0 = 1.5 so 9 requests should be allowed
+	clk.Add(time.Minute + 15*time.Second)
+	for i := 0; i < 9; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed in the third window", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the 10th request in the third window should be rejected")
+	}
+
+	// after two idle windows, the previous counter must be discarded
+	clk.Add(2 * time.Minute)
+	for i := 0; i < 10; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed after two idle windows", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the 11th request should be rejected after two idle windows")
+	}
+}
+
+func TestSlidingWindowCounter_State(t *testing.T) {
+	clk := newTestClock()
+	sw := NewSlidingWindowCounterWithClock(10, time.Minute, clk)
+
+	if st := sw.State(); st != (LimiterState{Limit: 10, Remaining: 10}) {
+		t.Errorf("unexpected state of an unused limiter: %+v", st)
+	}
+	for i := 0; i < 10; i++ {
+		sw.Allow()
+	}
+	clk.Add(30 * time.Second)
+	// the current window must become the previous one and start losing weight before
+	// accepting a new request
+	want := LimiterState{Limit: 10, RetryAfter: 30 * time.Second, Reset: 90 * time.Second}
+	if st := sw.State(); st != want {
+		t.Errorf("unexpected state of an exhausted limiter: %+v", st)
+	}
+
+	clk.Add(45 * time.Second)
+	// 10*0.75 = 7.5
+	want = LimiterState{Limit: 10, Remaining: 3, Reset: 45 * time.Second}
+	if st := sw.State(); st != want {
+		t.Errorf("unexpected state: %+v", st)
+	}
+}
@@ -0,0 +1,130 @@
+package krakendrate
+
+import (
+	"sync"
+	"time"
+)
+
+// NewSlidingWindowLog returns a sliding window log limiter allowing up to limit requests
+// in any window of the given duration, using the default clock
+func NewSlidingWindowLog(limit uint64, window time.Duration) *SlidingWindowLog {
+	return NewSlidingWindowLogWithClock(limit, window, nil)
+}
+
+// NewSlidingWindowLogWithClock returns a sliding window log limiter allowing up to limit
+// requests in any window of the given duration, using the received clock
+func NewSlidingWindowLogWithClock(limit uint64, window time.Duration, c Clock) *SlidingWindowLog {
+	return NewSlidingWindowLogBuilder(limit, window, c)().(*SlidingWindowLog)
+}
+
+// NewSlidingWindowLogBuilder returns a LimiterBuilderFn creating sliding window log limiters
+// with the given limit, window and clock
+func NewSlidingWindowLogBuilder(limit uint64, window time.Duration, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = time.Second
+	}
+
+	return func() interface{} {
+		return &SlidingWindowLog{
+			limit:  limit,
+			window: window,
+			clock:  clk,
+			mu:     new(sync.Mutex),
+		}
+	}
+}
+
+// SlidingWindowLog is an implementation of the sliding window log pattern. It keeps the
+// timestamps of the last accepted requests, so the limit is enforced exactly for any
+// window of time, at the cost of storing up to limit timestamps.
+type SlidingWindowLog struct {
+	limit  uint64
+	window time.Duration
+	clock  Clock
+	// log is a ring buffer with the timestamps of the accepted requests. It is
+	// lazily allocated and it never grows beyond limit entries.
+	log  []time.Time
+	head int
+	mu   *sync.Mutex
+}
+
+// Allow flags if the current request can be processed or not. It updates the internal state if
+// the request can be processed
+func (s *SlidingWindowLog) Allow() bool {
+	s.mu.Lock()
+	r := s.canConsume()
+	s.mu.Unlock()
+	return r
+}
+
+func (s *SlidingWindowLog) canConsume() bool {
+	n := s.clock.Now()
+
+	if uint64(len(s.log)) < s.limit {
+		s.log = append(s.log, n)
+		return true
+	}
+
+	// the log is full, so the oldest entry (the one at the head of the ring) must be
+	// out of the window in order to accept the request
+	if n.Sub(s.log[s.head]) < s.window {
+		return false
+	}
+
+	s.log[s.head] = n
+	s.head = (s.head + 1) % len(s.log)
+	return true
+}
+
+// Refund removes the newest n requests from the log
+func (s *SlidingWindowLog) Refund(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ; n > 0 && len(s.log) > 0; n-- {
+		if uint64(len(s.log)) < s.limit {
+			s.log = s.log[:len(s.log)-1]
+			continue
+		}
+		// the ring is full, so the newest entry is right before the head. Once cleared, it
+		// becomes the oldest one and the ring stays sorted from the head
+		s.head = (s.head + len(s.log) - 1) % len(s.log)
+		s.log[s.head] = time.Time{}
+	}
+}
+
+// State returns the current state of the limiter
+func (s *SlidingWindowLog) State() LimiterState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.clock.Now()
+	st := LimiterState{
+		Limit:     s.limit,
+		Remaining: s.limit,
+	}
+	if len(s.log) == 0 {
+		return st
+	}
+
+	// the entries of the ring are sorted from the head, so the last one is the newest
+	newest := s.log[(s.head+len(s.log)-1)%len(s.log)]
+	if d := s.window - n.Sub(newest); d > 0 {
+		st.Reset = d
+	}
+	for _, ts := range s.log {
+		if n.Sub(ts) < s.window {
+			st.Remaining--
+		}
+	}
+	if st.Remaining == 0 {
+		st.RetryAfter = s.window - n.Sub(s.log[s.head])
+	}
+	return st
+}
@@ -0,0 +1,144 @@
+package krakendrate
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLog(t *testing.T) {
+	clk := newTestClock()
+	sw := NewSlidingWindowLogWithClock(3, time.Minute, clk)
+
+	for i := 0; i < 3; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed", i)
+		}
+		clk.Add(10 * time.Second)
+	}
+	if sw.Allow() {
+		t.Error("the 4th request should be rejected")
+	}
+
+	// the first request was accepted 30s ago, so it leaves the window after 30s more
+	clk.Add(29 * time.Second)
+	if sw.Allow() {
+		t.Error("the request should be rejected because the window still contains 3 requests")
+	}
+	clk.Add(time.Second)
+	if !sw.Allow() {
+		t.Error("the request should be allowed because the first one left the window")
+	}
+	if sw.Allow() {
+		t.Error("the request should be rejected because the window contains 3 requests")
+	}
+
+	clk.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed after a full window", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the 4th request should be rejected after a full window")
+	}
+}
+
+func TestNewSlidingWindowLogBuilder(t *testing.T) {
+	clk := newTestClock()
+	store := NewLimiterFromBackendAndBuilder(NewMemoryBackend(t.Context(), time.Minute),
+		NewSlidingWindowLogBuilder(1, time.Second, clk))
+
+	if !store("a").Allow() {
+		t.Error("the first request of a should be allowed")
+	}
+	if store("a").Allow() {
+		t.Error("the second request of a should be rejected")
+	}
+	if !store("b").Allow() {
+		t.Error("the first request of b should be allowed")
+	}
+	clk.Add(time.Second)
+	if !store("a").Allow() {
+		t.Error("the third request of a should be allowed")
+	}
+}
+
+func TestSlidingWindowLog_State(t *testing.T) {
+	clk := newTestClock()
+	sw := NewSlidingWindowLogWithClock(2, time.Minute, clk)
+
+	if st := sw.State(); st != (LimiterState{Limit: 2, Remaining: 2}) {
+		t.Errorf("unexpected state of an unused limiter: %+v", st)
+	}
+	sw.Allow()
+	clk.Add(20 * time.Second)
+	sw.Allow()
+	clk.Add(10 * time.Second)
+
+	want := LimiterState{Limit: 2, RetryAfter: 30 * time.Second, Reset: 50 * time.Second}
+	if st := sw.State(); st != want {
+		t.Errorf("unexpected state of an exhausted limiter: %+v", st)
+	}
+
+	clk.Add(30 * time.Second)
+	want = LimiterState{Limit: 2, Remaining: 1, Reset: 20 * time.Second}
+	if st := sw.State(); st != want {
+		t.Errorf("unexpected state: %+v", st)
+	}
+}
+
+func TestSlidingWindowLog_Refund(t *testing.T) {
+	clk := newTestClock()
+	sw := NewSlidingWindowLogWithClock(2, time.Minute, clk)
+
+	sw.Allow()
+	sw.Refund(1)
+	sw.Allow()
+	clk.Add(time.Second)
+	sw.Allow()
+	if sw.Allow() {
+		t.Error("the limiter should be exhausted")
+	}
+	sw.Refund(2)
+	for i := 0; i < 2; i++ {
+		if !sw.Allow() {
+			t.Errorf("request #%d should be allowed after the refund", i)
+		}
+	}
+	if sw.Allow() {
+		t.Error("the limiter should be exhausted")
+	}
+}
+
+// testClock is a Clock that only moves when the tests tell it to do so
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *testClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+}
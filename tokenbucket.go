@@ -1,6 +1,9 @@
 package krakendrate
 
 import (
+	"context"
+	"math"
+	"math/bits"
 	"sync"
 	"time"
 )
@@ -26,105 +29,330 @@ func NewTokenBucketWithClock(rate float64, capacity uint64, c Clock) *TokenBucke
 // NewTokenBucketWithInitialStock returns a token bucket with the given rate, capacity, clock
 // and initial stock
 func NewTokenBucketWithInitialStock(r float64, capacity, i uint64, c Clock) *TokenBucket {
-	if c == nil {
-		c = defaultClock{}
-	}
-	if capacity < 1 {
-		capacity = 1
-	}
-	if i > capacity {
-		i = capacity
-	}
-	if r < 1e-9 {
-		r = 1e-9
-	}
-
-	return &TokenBucket{
-		fillInterval: time.Duration(int64(1e9 / r)),
-		capacity:     capacity,
-		clock:        c,
-		tokens:       i,
-		lastRefill:   c.Now(),
-		mu:           new(sync.Mutex),
-	}
+	return NewTokenBucketBuilder(r, capacity, i, c)().(*TokenBucket)
 }
 
 func NewTokenBucketBuilder(rate float64, capacity, initialStock uint64, clk Clock) LimiterBuilderFn {
-	// we do not call NewTokenBucketWithIntialStock inside the returned function to
-	// avoid the following block of checks that can be done just once
+	// the following block of checks is done just once, outside the returned function
 	if clk == nil {
 		clk = defaultClock{}
 	}
 	if capacity < 1 {
 		capacity = 1
 	}
+	if capacity > maxTokenBucketCapacity {
+		capacity = maxTokenBucketCapacity
+	}
 	if initialStock > capacity {
 		initialStock = capacity
 	}
-	if rate < 1e-9 {
-		rate = 1e-9
-	}
-	fillInterval := time.Duration(int64(1e9 / rate))
+	r := tokenBucketRate(rate)
 
 	return func() interface{} {
 		return &TokenBucket{
-			fillInterval: fillInterval,
-			capacity:     capacity,
-			clock:        clk,
-			tokens:       initialStock,
-			lastRefill:   clk.Now(),
-			mu:           new(sync.Mutex),
+			rate:       r,
+			capacity:   capacity,
+			clock:      clk,
+			balance:    int64(initialStock) * tokenUnit,
+			lastRefill: clk.Now(),
+			mu:         new(sync.Mutex),
 		}
 	}
 }
 
-// TokenBucket is an implementation of the token bucket pattern
+const (
+	// tokenUnit is the number of parts every token is split into, so the token bucket can keep
+	// fractions of tokens between refills
+	tokenUnit = 1_000_000_000
+
+	// maxTokenBucketCapacity and minTokenBucketBalance keep the balance of the bucket far
+	// from the int64 limits
+	maxTokenBucketCapacity = math.MaxInt64 / 4 / tokenUnit
+	minTokenBucketBalance  = -math.MaxInt64 / 4
+
+	minTokenBucketRate = 1e-9
+	maxTokenBucketRate = 1e10
+)
+
+// tokenBucketRate returns the rate in nano-tokens per second
+func tokenBucketRate(rate float64) uint64 {
+	if rate < minTokenBucketRate {
+		rate = minTokenBucketRate
+	}
+	if rate > maxTokenBucketRate {
+		rate = maxTokenBucketRate
+	}
+	return uint64(math.Round(rate * tokenUnit))
+}
+
+// TokenBucket is an implementation of the token bucket pattern.
+//
+// Its balance is a fixed-point amount of nano-tokens and every refill keeps the remainder of the
+// division, so fractional and very low rates (like 3 tokens every 7 seconds) never lose or gain
+// tokens over time. A negative balance means the bucket owes the tokens reserved in advance.
 type TokenBucket struct {
-	fillInterval time.Duration
-	capacity     uint64
-	tokens       uint64
-	clock        Clock
-	lastRefill   time.Time
-	mu           *sync.Mutex
+	// rate is the amount of nano-tokens generated per second
+	rate     uint64
+	capacity uint64
+	// balance is the amount of nano-tokens in the bucket
+	balance int64
+	// carry is the remainder (in units of 1e-9 nano-tokens) left by the previous refills
+	carry      uint64
+	warmUp     *warmUp
+	clock      Clock
+	lastRefill time.Time
+	mu         *sync.Mutex
 }
 
 // Allow flags if the current request can be processed or not. It updates the internal state if
 // the request can be processed
 func (t *TokenBucket) Allow() bool {
 	t.mu.Lock()
-	r := t.canConsume()
+	r := t.canConsumeN(1)
+	t.mu.Unlock()
+	return r
+}
+
+// AllowN flags if n tokens can be consumed from the bucket or not. It updates the internal state if
+// the tokens can be consumed
+func (t *TokenBucket) AllowN(n uint64) bool {
+	t.mu.Lock()
+	r := t.canConsumeN(n)
 	t.mu.Unlock()
 	return r
 }
 
-func (t *TokenBucket) canConsume() bool {
-	if t.tokens > 0 {
-		// delay the refill until the bucket is empty
-		t.tokens--
-		return true
+// Wait blocks until n tokens can be consumed from the bucket. It returns ErrWaitDeadline without
+// waiting if the tokens will not be available before the deadline of the context, ErrLimited if
+// n exceeds the capacity of the bucket and the error of the context if it is done while waiting.
+func (t *TokenBucket) Wait(ctx context.Context, n uint64) error {
+	r := t.Reserve(n)
+	if !r.OK() {
+		return ErrLimited
+	}
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(r.TimeToAct()) {
+		r.Cancel()
+		return ErrWaitDeadline
 	}
 
-	// if there are no more tokens in the bucket, calculate how many tokens should be added
-	tokensToAdd := uint64(t.clock.Since(t.lastRefill) / t.fillInterval)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
 
-	// if there are no tokens to be added to the empty bucket
-	if tokensToAdd == 0 {
-		return false
+// Reserve takes n tokens from the bucket, even if they are not available yet, and returns a
+// Reservation reporting when they can be used. The reservation is not OK if n exceeds the
+// capacity of the bucket.
+func (t *TokenBucket) Reserve(n uint64) *Reservation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n > t.capacity {
+		return &Reservation{}
+	}
+
+	r := &Reservation{
+		ok:        true,
+		tokens:    n,
+		timeToAct: t.clock.Now(),
+		clock:     t.clock,
+		refund:    t.Refund,
+	}
+	if t.canConsumeN(n) {
+		return r
+	}
+
+	// the missing tokens are borrowed from the future and the next refills repay them
+	// before any other token can be consumed
+	t.balance -= int64(n) * tokenUnit
+	r.timeToAct = t.lastRefill.Add(t.timeToGenerate(uint64(-t.balance)))
+	return r
+}
+
+// Charge takes n tokens from the bucket after the fact, even if they are not available, so the
+// real cost of a request can be accounted once it is known. When the balance is not enough, the
+// bucket goes into debt and rejects the requests until the refills repay it.
+func (t *TokenBucket) Charge(n uint64) {
+	t.mu.Lock()
+	t.refill()
+	if n > maxTokenBucketCapacity || t.balance-int64(n)*tokenUnit < minTokenBucketBalance {
+		t.balance = minTokenBucketBalance
+	} else {
+		t.balance -= int64(n) * tokenUnit
+	}
+	t.mu.Unlock()
+}
+
+// SetRate changes the refill rate of the bucket. The tokens generated with the previous rate,
+// including the fraction of the next one, are kept. During a warm-up, the new rate becomes the
+// target of the ramp.
+func (t *TokenBucket) SetRate(rate float64) {
+	r := tokenBucketRate(rate)
+
+	t.mu.Lock()
+	t.refill()
+	t.rate = r
+	t.carry = 0
+	t.mu.Unlock()
+}
+
+// SetCapacity changes the capacity of the bucket, rescaling the current amount of tokens
+// proportionally, so a half-full bucket is still half-full after the change.
+func (t *TokenBucket) SetCapacity(capacity uint64) {
+	if capacity < 1 {
+		capacity = 1
 	}
+	if capacity > maxTokenBucketCapacity {
+		capacity = maxTokenBucketCapacity
+	}
+
+	t.mu.Lock()
+	t.refill()
+	if t.balance > 0 {
+		// the balance never exceeds the previous capacity, so the quotient fits in 64 bits
+		hi, lo := bits.Mul64(uint64(t.balance), capacity)
+		b, _ := bits.Div64(hi, lo, t.capacity)
+		t.balance = int64(b)
+	}
+	t.capacity = capacity
+	t.mu.Unlock()
+}
 
-	// update the time of the last refill depending on how many tokens we added
-	t.lastRefill = t.lastRefill.Add(time.Duration(tokensToAdd) * t.fillInterval)
+// State returns the current state of the bucket
+func (t *TokenBucket) State() LimiterState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	// normalize the amount of tokens to add
-	if t.tokens+tokensToAdd > t.capacity {
-		t.tokens = t.capacity
-		return true
+	t.refill()
+	st := LimiterState{Limit: t.capacity}
+	if t.balance >= tokenUnit {
+		st.Remaining = uint64(t.balance / tokenUnit)
+	} else {
+		st.RetryAfter = t.timeToGenerate(uint64(tokenUnit - t.balance))
+	}
+	if full := int64(t.capacity) * tokenUnit; t.balance < full {
+		st.Reset = t.timeToGenerate(uint64(full - t.balance))
 	}
+	return st
+}
 
-	t.tokens += tokensToAdd - 1
+// Refund gives n tokens back to the bucket. They repay its debt, if any, before being added
+func (t *TokenBucket) Refund(n uint64) {
+	t.mu.Lock()
+	full := int64(t.capacity) * tokenUnit
+	if n > t.capacity || t.balance+int64(n)*tokenUnit > full {
+		t.balance = full
+	} else {
+		t.balance += int64(n) * tokenUnit
+	}
+	t.mu.Unlock()
+}
+
+func (t *TokenBucket) canConsumeN(n uint64) bool {
+	if n > t.capacity {
+		return false
+	}
+	cost := int64(n) * tokenUnit
+	if t.balance < cost {
+		// refill only when the bucket does not have enough tokens
+		t.refill()
+		if t.balance < cost {
+			return false
+		}
+	}
+	t.balance -= cost
 	return true
 }
 
+// refill adds the nano-tokens generated since the last refill, up to the capacity of the bucket.
+// The generated tokens repay the debt of the bucket, if any, before being available.
+func (t *TokenBucket) refill() {
+	now := t.clock.Now()
+	if t.warmUp != nil {
+		if now.Before(t.warmUp.end) {
+			t.refillUntil(now, t.warmUp.averageRate(t.lastRefill, now, t.rate))
+			return
+		}
+		if t.lastRefill.Before(t.warmUp.end) {
+			t.refillUntil(t.warmUp.end, t.warmUp.averageRate(t.lastRefill, t.warmUp.end, t.rate))
+		}
+		t.warmUp = nil
+	}
+	t.refillUntil(now, t.rate)
+}
+
+// refillUntil adds the nano-tokens generated at the given rate between the last refill and now
+func (t *TokenBucket) refillUntil(now time.Time, rate uint64) {
+	elapsed := now.Sub(t.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+	t.lastRefill = now
+
+	full := int64(t.capacity) * tokenUnit
+	if t.balance >= full {
+		t.carry = 0
+		return
+	}
+
+	// generated = (elapsed * rate + carry) / 1e9, computed with 128 bits in order to avoid
+	// overflows and to keep the remainder for the next refill
+	hi, lo := bits.Mul64(uint64(elapsed), rate)
+	lo, c := bits.Add64(lo, t.carry, 0)
+	hi += c
+	if hi >= tokenUnit {
+		// the quotient does not fit in 64 bits, so it is way bigger than the missing tokens
+		t.balance = full
+		t.carry = 0
+		return
+	}
+	generated, carry := bits.Div64(hi, lo, tokenUnit)
+	if generated >= uint64(full-t.balance) {
+		t.balance = full
+		t.carry = 0
+		return
+	}
+	t.balance += int64(generated)
+	t.carry = carry
+}
+
+// timeToGenerate returns the time required to generate the received amount of nano-tokens,
+// taking into account the remainder of the previous refills
+func (t *TokenBucket) timeToGenerate(nanoTokens uint64) time.Duration {
+	rate := t.rate
+	if t.warmUp != nil {
+		// the rate keeps growing during the warm-up, so the current one gives an upper bound
+		rate = t.warmUp.rateAt(t.lastRefill, rate)
+	}
+	hi, lo := bits.Mul64(nanoTokens, tokenUnit)
+	lo, b := bits.Sub64(lo, t.carry, 0)
+	hi -= b
+	if hi >= rate {
+		return math.MaxInt64
+	}
+	d, rem := bits.Div64(hi, lo, rate)
+	if rem > 0 {
+		d++
+	}
+	if d > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// SystemClock is the Clock returning the system time, used by default by all the limiters
+var SystemClock Clock = defaultClock{}
+
 type defaultClock struct{}
 
 func (defaultClock) Now() time.Time {
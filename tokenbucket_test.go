@@ -0,0 +1,200 @@
+package krakendrate
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_AllowN(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(10, 10, clk)
+
+	if !tb.AllowN(7) {
+		t.Error("7 tokens should be allowed")
+	}
+	if tb.AllowN(4) {
+		t.Error("4 tokens should not be allowed when only 3 remain")
+	}
+	if !tb.AllowN(3) {
+		t.Error("3 tokens should be allowed")
+	}
+	if tb.Allow() {
+		t.Error("the bucket should be empty")
+	}
+
+	clk.Add(250 * time.Millisecond)
+	if !tb.AllowN(2) {
+		t.Error("2 tokens should be allowed after the refill")
+	}
+	if tb.AllowN(1) {
+		t.Error("the bucket should be empty after consuming the refill")
+	}
+
+	clk.Add(time.Hour)
+	if tb.AllowN(11) {
+		t.Error("the bucket should not allow more tokens than its capacity")
+	}
+	if !tb.AllowN(10) {
+		t.Error("the bucket should be full after a long idle period")
+	}
+}
+
+func TestTokenBucket_fractionalRate(t *testing.T) {
+	clk := newTestClock()
+	// 3 tokens every 7 seconds
+	tb := NewTokenBucketWithInitialStock(3.0/7, 3, 0, clk)
+
+	allowed := 0
+	for i := 0; i < 7000; i++ {
+		clk.Add(10 * time.Millisecond)
+		if tb.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 30 {
+		t.Errorf("unexpected number of allowed requests in 70 seconds: %d", allowed)
+	}
+
+	tb = NewTokenBucketWithInitialStock(1e-6, 1, 0, clk)
+	if st := tb.State(); st.RetryAfter != 1e6*time.Second {
+		t.Errorf("unexpected retry after for a very low rate: %s", st.RetryAfter)
+	}
+	clk.Add(1e6*time.Second - time.Nanosecond)
+	if tb.Allow() {
+		t.Error("the token should not be ready yet")
+	}
+	clk.Add(time.Nanosecond)
+	if !tb.Allow() {
+		t.Error("the token should be ready")
+	}
+}
+
+func TestTokenBucket_Wait(t *testing.T) {
+	tb := NewTokenBucket(20, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := tb.Wait(ctx, 1); err != nil {
+			t.Errorf("request #%d: unexpected error: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("the requests were not delayed: %s", elapsed)
+	}
+
+	if err := tb.Wait(ctx, 2); err != ErrLimited {
+		t.Errorf("unexpected error waiting for more tokens than the capacity: %v", err)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	start = time.Now()
+	if err := tb.Wait(short, 1); err != ErrWaitDeadline {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("the wait should fail without waiting: %s", elapsed)
+	}
+}
+
+func TestTokenBucket_State(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(10, 5, clk)
+
+	if st := tb.State(); st != (LimiterState{Limit: 5, Remaining: 5}) {
+		t.Errorf("unexpected state of a full bucket: %+v", st)
+	}
+
+	tb.AllowN(5)
+	clk.Add(50 * time.Millisecond)
+	want := LimiterState{Limit: 5, RetryAfter: 50 * time.Millisecond, Reset: 450 * time.Millisecond}
+	if st := tb.State(); st != want {
+		t.Errorf("unexpected state of an empty bucket: %+v", st)
+	}
+
+	clk.Add(250 * time.Millisecond)
+	want = LimiterState{Limit: 5, Remaining: 3, Reset: 200 * time.Millisecond}
+	if st := tb.State(); st != want {
+		t.Errorf("unexpected state of a partially refilled bucket: %+v", st)
+	}
+	if !tb.AllowN(3) {
+		t.Error("the state should not consume tokens")
+	}
+}
+
+func TestTokenBucket_SetRate(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(10, 10, clk)
+
+	tb.AllowN(8)
+	clk.Add(50 * time.Millisecond)
+	// half a token was generated with the old rate, so a quarter of a second is
+	// needed to complete it with the new one
+	tb.SetRate(2)
+	if st := tb.State(); st.Remaining != 2 || st.RetryAfter != 0 || st.Reset != 3750*time.Millisecond {
+		t.Errorf("unexpected state after changing the rate: %+v", st)
+	}
+
+	tb.AllowN(2)
+	clk.Add(249 * time.Millisecond)
+	if tb.Allow() {
+		t.Error("the token should not be ready yet")
+	}
+	clk.Add(time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the token should be ready")
+	}
+}
+
+func TestTokenBucket_SetCapacity(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(1, 10, clk)
+
+	tb.AllowN(4)
+	tb.SetCapacity(5)
+	if st := tb.State(); st.Limit != 5 || st.Remaining != 3 {
+		t.Errorf("unexpected state after reducing the capacity: %+v", st)
+	}
+
+	tb.SetCapacity(20)
+	if st := tb.State(); st.Limit != 20 || st.Remaining != 12 {
+		t.Errorf("unexpected state after increasing the capacity: %+v", st)
+	}
+
+	clk.Add(time.Hour)
+	if !tb.AllowN(20) {
+		t.Error("the bucket should be refilled up to the new capacity")
+	}
+}
+
+func TestTokenBucket_Charge(t *testing.T) {
+	clk := newTestClock()
+	tb := NewTokenBucketWithClock(10, 10, clk)
+
+	if !tb.Allow() {
+		t.Error("the first request should be allowed")
+	}
+	// the real cost of the request was 25 tokens
+	tb.Charge(24)
+	if st := tb.State(); st.Remaining != 0 || st.RetryAfter != 1600*time.Millisecond {
+		t.Errorf("unexpected state of a bucket in debt: %+v", st)
+	}
+	clk.Add(1500 * time.Millisecond)
+	if tb.Allow() {
+		t.Error("the request should be rejected until the debt is repaid")
+	}
+	clk.Add(100 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("the request should be allowed once the debt is repaid")
+	}
+
+	tb.Charge(math.MaxUint64)
+	if st := tb.State(); st.Remaining != 0 || st.RetryAfter <= 0 {
+		t.Errorf("unexpected state of a bucket with the max debt: %+v", st)
+	}
+}
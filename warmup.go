@@ -0,0 +1,84 @@
+package krakendrate
+
+import (
+	"time"
+)
+
+// NewWarmUpTokenBucket returns a token bucket with the given capacity whose rate grows linearly from
+// coldRate to rate during the warm-up period, using the default clock
+func NewWarmUpTokenBucket(rate, coldRate float64, capacity uint64, period time.Duration) *TokenBucket {
+	return NewWarmUpTokenBucketWithClock(rate, coldRate, capacity, period, nil)
+}
+
+// NewWarmUpTokenBucketWithClock returns a token bucket with the given capacity whose rate grows
+// linearly from coldRate to rate during the warm-up period, using the received clock
+func NewWarmUpTokenBucketWithClock(rate, coldRate float64, capacity uint64, period time.Duration, c Clock) *TokenBucket {
+	return NewWarmUpTokenBucketBuilder(rate, coldRate, capacity, period, c)().(*TokenBucket)
+}
+
+// NewWarmUpTokenBucketBuilder returns a LimiterBuilderFn creating token buckets in warm-up mode: the
+// rate of every bucket grows linearly from coldRate to rate during the warm-up period following its
+// creation. The initial stock of the buckets is proportional to the cold rate, so a cold backend
+// does not receive a full burst either. A warm-up period of zero or a cold rate not lower than the
+// rate returns regular token buckets.
+func NewWarmUpTokenBucketBuilder(rate, coldRate float64, capacity uint64, period time.Duration, clk Clock) LimiterBuilderFn {
+	if clk == nil {
+		clk = defaultClock{}
+	}
+	if period <= 0 || coldRate >= rate {
+		return NewTokenBucketBuilder(rate, capacity, capacity, clk)
+	}
+
+	cold := tokenBucketRate(coldRate)
+	initialStock := uint64(float64(capacity) * float64(cold) / float64(tokenBucketRate(rate)))
+	builder := NewTokenBucketBuilder(rate, capacity, initialStock, clk)
+
+	return func() interface{} {
+		tb := builder().(*TokenBucket)
+		tb.warmUp = &warmUp{
+			cold:  cold,
+			start: tb.lastRefill,
+			end:   tb.lastRefill.Add(period),
+		}
+		return tb
+	}
+}
+
+// SetColdRate changes the rate at the start of the warm-up of the bucket, so the rest of the ramp
+// goes from it to the rate of the bucket. It has no effect on buckets not warming up.
+func (t *TokenBucket) SetColdRate(rate float64) {
+	cold := tokenBucketRate(rate)
+
+	t.mu.Lock()
+	t.refill()
+	if t.warmUp != nil {
+		t.warmUp.cold = cold
+	}
+	t.mu.Unlock()
+}
+
+// warmUp ramps the rate of a token bucket linearly from the cold rate to the rate of the bucket
+type warmUp struct {
+	// cold is the amount of nano-tokens generated per second at the start of the warm-up
+	cold  uint64
+	start time.Time
+	end   time.Time
+}
+
+// rateAt returns the rate of the ramp ending at the given rate at the instant x
+func (w *warmUp) rateAt(x time.Time, rate uint64) uint64 {
+	if !x.Before(w.end) {
+		return rate
+	}
+	if !x.After(w.start) {
+		return w.cold
+	}
+	progress := float64(x.Sub(w.start)) / float64(w.end.Sub(w.start))
+	return uint64(float64(w.cold) + progress*(float64(rate)-float64(w.cold)))
+}
+
+// averageRate returns the average rate of the ramp between the instants from and to. Since the
+// ramp is linear, it is the rate at the middle of the interval.
+func (w *warmUp) averageRate(from, to time.Time, rate uint64) uint64 {
+	return w.rateAt(from.Add(to.Sub(from)/2), rate)
+}
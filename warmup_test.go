@@ -0,0 +1,76 @@
+package krakendrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmUpTokenBucket(t *testing.T) {
+	clk := newTestClock()
+	// from 10 to 30 tokens per second in 10 seconds
+	tb := NewWarmUpTokenBucketWithClock(30, 10, 30, 10*time.Second, clk)
+
+	if st := tb.State(); st.Remaining != 10 {
+		t.Errorf("the initial stock should be proportional to the cold rate: %+v", st)
+	}
+	tb.AllowN(10)
+
+	// the average rate of the first 5 seconds is 15 tokens per second
+	clk.Add(time.Second)
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		for tb.Allow() {
+			allowed++
+		}
+		clk.Add(time.Second)
+	}
+	for tb.Allow() {
+		allowed++
+	}
+	if allowed != 75 {
+		t.Errorf("unexpected number of tokens during the first half of the warm-up: %d", allowed)
+	}
+
+	// the refill crossing the end of the warm-up fills the bucket and completes the ramp
+	clk.Add(6 * time.Second)
+	if !tb.AllowN(30) {
+		t.Error("the bucket should be full")
+	}
+	if tb.warmUp != nil {
+		t.Error("the warm-up should be over")
+	}
+	clk.Add(100 * time.Millisecond)
+	if !tb.AllowN(3) || tb.Allow() {
+		t.Error("the bucket should be refilled at the max rate after the warm-up")
+	}
+}
+
+func TestWarmUpTokenBucket_disabled(t *testing.T) {
+	clk := newTestClock()
+	tb := NewWarmUpTokenBucketWithClock(10, 20, 10, time.Minute, clk)
+	if tb.warmUp != nil {
+		t.Error("a cold rate higher than the rate should disable the warm-up")
+	}
+	if !tb.AllowN(10) {
+		t.Error("the bucket should start full")
+	}
+}
+
+func TestWarmUpTokenBucket_SetColdRate(t *testing.T) {
+	clk := newTestClock()
+	tb := NewWarmUpTokenBucketWithClock(40, 20, 40, 10*time.Second, clk)
+	tb.SetRate(20)
+	tb.SetColdRate(10)
+	for tb.Allow() {
+	}
+
+	// the average rate of the first second of a ramp from 10 to 20 tokens per second is 10.5
+	clk.Add(time.Second)
+	allowed := 0
+	for tb.Allow() {
+		allowed++
+	}
+	if allowed != 10 {
+		t.Errorf("unexpected number of tokens with the new cold rate: %d", allowed)
+	}
+}